@@ -0,0 +1,46 @@
+package main
+
+import (
+	"time"
+
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Build metadata for the standard `org.opencontainers.image.*` labels and
+// manifest annotations
+type ConfigStandardAnnotations struct {
+	Source   string `json:"source"`
+	Revision string `json:"revision"`
+	Version  string `json:"version"`
+}
+
+// The standard annotations for the image, for the fields that are known. Values
+// can reference environment variables or files like credentials (ex: the commit
+// from the CI environment).
+func standardAnnotations(config Config) (map[string]string, error) {
+	out := map[string]string{}
+	// The same time as the image config's (after SOURCE_DATE_EPOCH is applied),
+	// which is omitted if not set
+	if !config.Created.IsZero() {
+		out[imagespec.AnnotationCreated] = config.Created.UTC().Format(time.RFC3339)
+	}
+	for _, f := range []struct {
+		field string
+		key   string
+		value string
+	}{
+		{"source", imagespec.AnnotationSource, config.StandardAnnotations.Source},
+		{"revision", imagespec.AnnotationRevision, config.StandardAnnotations.Revision},
+		{"version", imagespec.AnnotationVersion, config.StandardAnnotations.Version},
+	} {
+		v, err := resolveSecret("standard_annotations."+f.field, f.value)
+		if err != nil {
+			return nil, err
+		}
+		if v == "" {
+			continue
+		}
+		out[f.key] = v
+	}
+	return out, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/types"
+	"golang.org/x/oauth2/google"
+)
+
+var ecrHostRegex = regexp.MustCompile(`^[0-9]+\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?$`)
+
+// Get registry credentials for `ref` using a provider-specific auth mode. Requests
+// to the registry itself use the TLS settings from `sysCtx`.
+func registryAuth(ctx context.Context, mode string, ref types.ImageReference, sysCtx *types.SystemContext) (*types.DockerAuthConfig, error) {
+	named := ref.DockerReference()
+	if named == nil {
+		return nil, fmt.Errorf("auth mode %s can only be used with registry refs (docker://), but got %s", mode, transports.ImageName(ref))
+	}
+	host := reference.Domain(named)
+	switch mode {
+	case "ecr":
+		return ecrAuth(ctx, host)
+	case "gcp-adc":
+		return gcpAdcAuth(ctx, host)
+	case "acr":
+		return acrAuth(ctx, host, sysCtx)
+	case "secret-service":
+		return secretServiceAuth(host)
+	default:
+		if helper, found := strings.CutPrefix(mode, "helper:"); found {
+			return credentialHelperAuth(helper, host)
+		}
+		return nil, fmt.Errorf("unknown auth mode %s, must be one of ecr, gcp-adc, acr, helper:NAME, or secret-service", mode)
+	}
+}
+
+// Get a token for ECR using the standard AWS credential chain (env vars, shared
+// config, instance/task roles, etc)
+func ecrAuth(ctx context.Context, host string) (*types.DockerAuthConfig, error) {
+	match := ecrHostRegex.FindStringSubmatch(host)
+	if match == nil {
+		return nil, fmt.Errorf("registry %s doesn't look like an ECR registry (ACCOUNT.dkr.ecr.REGION.amazonaws.com)", host)
+	}
+	awsConfig, err := config.LoadDefaultConfig(ctx, config.WithRegion(match[1]))
+	if err != nil {
+		return nil, fmt.Errorf("error loading AWS config for ECR auth: %w", err)
+	}
+	resp, err := ecr.NewFromConfig(awsConfig).GetAuthorizationToken(ctx, &ecr.GetAuthorizationTokenInput{})
+	if err != nil {
+		return nil, fmt.Errorf("error getting ECR authorization token for %s: %w", host, err)
+	}
+	if len(resp.AuthorizationData) == 0 || resp.AuthorizationData[0].AuthorizationToken == nil {
+		return nil, fmt.Errorf("ECR returned no authorization token for %s", host)
+	}
+	token, err := base64.StdEncoding.DecodeString(*resp.AuthorizationData[0].AuthorizationToken)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding ECR authorization token for %s: %w", host, err)
+	}
+	user, password, found := strings.Cut(string(token), ":")
+	if !found {
+		return nil, fmt.Errorf("ECR authorization token for %s is not in the format USER:PASSWORD", host)
+	}
+	return &types.DockerAuthConfig{
+		Username: user,
+		Password: password,
+	}, nil
+}
+
+// Get an OAuth token for Artifact Registry or Container Registry using Google
+// Application Default Credentials (GOOGLE_APPLICATION_CREDENTIALS, gcloud
+// credentials, or the metadata server)
+func gcpAdcAuth(ctx context.Context, host string) (*types.DockerAuthConfig, error) {
+	if !strings.HasSuffix(host, ".pkg.dev") && host != "gcr.io" && !strings.HasSuffix(host, ".gcr.io") {
+		return nil, fmt.Errorf("registry %s doesn't look like a Google registry (*.pkg.dev or *gcr.io)", host)
+	}
+	creds, err := google.FindDefaultCredentials(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		return nil, fmt.Errorf("error finding Google application default credentials: %w", err)
+	}
+	token, err := creds.TokenSource.Token()
+	if err != nil {
+		return nil, fmt.Errorf("error getting OAuth token from Google application default credentials for %s: %w", host, err)
+	}
+	return &types.DockerAuthConfig{
+		Username: "oauth2accesstoken",
+		Password: token.AccessToken,
+	}, nil
+}
+
+// Exchange an Azure AD token from the default Azure credential chain (env vars,
+// workload identity, managed identity, az cli) for an ACR refresh token
+func acrAuth(ctx context.Context, host string, sysCtx *types.SystemContext) (*types.DockerAuthConfig, error) {
+	if !strings.HasSuffix(host, ".azurecr.io") {
+		return nil, fmt.Errorf("registry %s doesn't look like an ACR registry (*.azurecr.io)", host)
+	}
+	cred, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up default Azure credentials: %w", err)
+	}
+	aadToken, err := cred.GetToken(ctx, policy.TokenRequestOptions{
+		Scopes: []string{"https://management.azure.com/.default"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error getting Azure AD token for %s: %w", host, err)
+	}
+	client, err := registryHttpClient(sysCtx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {host},
+		"access_token": {aadToken.Token},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("https://%s/oauth2/exchange", host), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("error creating ACR token exchange request for %s: %w", host, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error exchanging Azure AD token for ACR refresh token with %s: %w", host, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading ACR token exchange response from %s: %w", host, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ACR token exchange with %s failed with status %s: %s", host, resp.Status, body)
+	}
+	var exchange struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(body, &exchange); err != nil {
+		return nil, fmt.Errorf("error parsing ACR token exchange response from %s: %w", host, err)
+	}
+	if exchange.RefreshToken == "" {
+		return nil, fmt.Errorf("ACR token exchange with %s returned no refresh token", host)
+	}
+	// ACR expects this fixed user name when using refresh tokens
+	return &types.DockerAuthConfig{
+		Username: "00000000-0000-0000-0000-000000000000",
+		Password: exchange.RefreshToken,
+	}, nil
+}
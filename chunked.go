@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andrewbaxter/dinker/dinkerlib"
+	remotesdocker "github.com/containerd/containerd/remotes/docker"
+	"github.com/containers/image/v5/docker/reference"
+	dockerconfig "github.com/containers/image/v5/pkg/docker/config"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+)
+
+// Uploads blobs to a registry repo with the chunked upload api, so failed
+// uploads can resume from the last byte the registry received instead of
+// starting over
+type chunkedUploader struct {
+	client     *http.Client
+	authorizer remotesdocker.Authorizer
+	// Sent as-is if specified, instead of using the authorizer
+	token string
+	// Ex: `https://registry.example.com/v2/org/repo`
+	repoUrl    string
+	chunkSize  int64
+	retries    int
+	retryDelay time.Duration
+}
+
+func newChunkedUploader(ctx context.Context, sysCtx *types.SystemContext, named reference.Named, http_ bool, chunkSize int64, retries int, retryDelay time.Duration) (*chunkedUploader, error) {
+	client, err := registryHttpClient(sysCtx)
+	if err != nil {
+		return nil, err
+	}
+	creds := func(host string) (string, string, error) {
+		// Looks in auth files if no credentials were specified
+		auth, err := dockerconfig.GetCredentialsForRef(sysCtx, named)
+		if err != nil {
+			return "", "", fmt.Errorf("error getting credentials for %s: %w", host, err)
+		}
+		if auth.IdentityToken != "" {
+			// Treated as a refresh token with no username
+			return "", auth.IdentityToken, nil
+		}
+		return auth.Username, auth.Password, nil
+	}
+	host := reference.Domain(named)
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+	}
+	u := &chunkedUploader{
+		client:     client,
+		authorizer: remotesdocker.NewDockerAuthorizer(remotesdocker.WithAuthClient(client), remotesdocker.WithAuthCreds(creds)),
+		token:      sysCtx.DockerBearerRegistryToken,
+		chunkSize:  chunkSize,
+		retries:    retries,
+		retryDelay: retryDelay,
+	}
+	// Like containers/image, fall back to http if allowed and https doesn't work
+	var pingErr error
+	for _, scheme := range []string{"https", "http"} {
+		if scheme == "http" && !http_ {
+			break
+		}
+		u.repoUrl = fmt.Sprintf("%s://%s/v2/%s", scheme, host, reference.Path(named))
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s://%s/v2/", scheme, host), nil)
+		if err != nil {
+			return nil, fmt.Errorf("error creating registry ping request: %w", err)
+		}
+		resp, err := u.client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			return u, nil
+		}
+		pingErr = errors.Join(pingErr, err)
+	}
+	return nil, fmt.Errorf("error connecting to registry %s: %w", host, pingErr)
+}
+
+// Send a request, authenticating if the registry asks for credentials
+func (u *chunkedUploader) do(ctx context.Context, method string, reqUrl string, body []byte, header http.Header) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, reqUrl, bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("error creating %s request: %w", method, err)
+		}
+		req.ContentLength = int64(len(body))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if u.token != "" {
+			req.Header.Set("Authorization", "Bearer "+u.token)
+		} else if err := u.authorizer.Authorize(ctx, req); err != nil {
+			return nil, fmt.Errorf("error authorizing %s request: %w", method, err)
+		}
+		resp, err := u.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 || u.token != "" {
+			return resp, nil
+		}
+		err = u.authorizer.AddResponses(ctx, []*http.Response{resp})
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error authenticating: %w", err)
+		}
+	}
+}
+
+// Resolve the upload location returned by the registry, which may be relative
+func (u *chunkedUploader) location(resp *http.Response) (string, error) {
+	loc := resp.Header.Get("Location")
+	if loc == "" {
+		return "", fmt.Errorf("registry response is missing the upload location")
+	}
+	parsed, err := resp.Request.URL.Parse(loc)
+	if err != nil {
+		return "", fmt.Errorf("invalid upload location %s: %w", loc, err)
+	}
+	return parsed.String(), nil
+}
+
+func (u *chunkedUploader) exists(ctx context.Context, d digest.Digest) (bool, error) {
+	resp, err := u.do(ctx, http.MethodHead, fmt.Sprintf("%s/blobs/%s", u.repoUrl, d), nil, nil)
+	if err != nil {
+		return false, fmt.Errorf("error checking for blob %s: %w", d, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// Start a new upload, returning its location
+func (u *chunkedUploader) start(ctx context.Context) (string, error) {
+	resp, err := u.do(ctx, http.MethodPost, u.repoUrl+"/blobs/uploads/", nil, nil)
+	if err != nil {
+		return "", fmt.Errorf("error starting upload: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return "", fmt.Errorf("error starting upload: registry responded %s", resp.Status)
+	}
+	return u.location(resp)
+}
+
+// Ask the registry how much of an upload it has, returning the offset to
+// resume from
+func (u *chunkedUploader) status(ctx context.Context, loc string) (string, int64, error) {
+	resp, err := u.do(ctx, http.MethodGet, loc, nil, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return "", 0, fmt.Errorf("registry responded %s", resp.Status)
+	}
+	newLoc, err := u.location(resp)
+	if err != nil {
+		return "", 0, err
+	}
+	// Inclusive, ex: `0-1023`, missing if nothing was received
+	rangeHeader := resp.Header.Get("Range")
+	if rangeHeader == "" {
+		return newLoc, 0, nil
+	}
+	_, end, found := strings.Cut(rangeHeader, "-")
+	if !found {
+		return "", 0, fmt.Errorf("invalid upload range %s", rangeHeader)
+	}
+	last, err := strconv.ParseInt(end, 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid upload range %s: %w", rangeHeader, err)
+	}
+	return newLoc, last + 1, nil
+}
+
+func (u *chunkedUploader) sendChunk(ctx context.Context, loc string, f *os.File, offset int64, size int64) (string, error) {
+	chunk := make([]byte, min(u.chunkSize, size-offset))
+	if _, err := f.ReadAt(chunk, offset); err != nil {
+		return "", fmt.Errorf("error reading blob: %w", err)
+	}
+	resp, err := u.do(ctx, http.MethodPatch, loc, chunk, http.Header{
+		"Content-Type":  {"application/octet-stream"},
+		"Content-Range": {fmt.Sprintf("%d-%d", offset, offset+int64(len(chunk))-1)},
+	})
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return "", fmt.Errorf("registry responded %s", resp.Status)
+	}
+	return u.location(resp)
+}
+
+// Upload the blob at `p` in chunks, resuming after errors
+func (u *chunkedUploader) upload(ctx context.Context, p dinkerlib.AbsPath, d digest.Digest, size int64) error {
+	f, err := os.Open(p.Raw())
+	if err != nil {
+		return fmt.Errorf("error opening blob %s: %w", d, err)
+	}
+	defer f.Close()
+	loc, err := u.start(ctx)
+	if err != nil {
+		return err
+	}
+	offset := int64(0)
+	failures := 0
+	retryDelay := u.retryDelay
+	for offset < size {
+		newLoc, err := u.sendChunk(ctx, loc, f, offset, size)
+		if err == nil {
+			loc = newLoc
+			offset += min(u.chunkSize, size-offset)
+			failures = 0
+			retryDelay = u.retryDelay
+			logVerbose("Uploaded %d of %d bytes of %s", offset, size, d)
+			continue
+		}
+		failures += 1
+		if failures > u.retries || ctx.Err() != nil {
+			return fmt.Errorf("error uploading blob %s at offset %d: %w", d, offset, err)
+		}
+		log.Printf("Error uploading blob %s at offset %d, resuming in %s: %s", d, offset, retryDelay, err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(retryDelay):
+		}
+		retryDelay *= 2
+		statusLoc, statusOffset, err := u.status(ctx, loc)
+		if err != nil {
+			log.Printf("Error getting upload status for blob %s, restarting upload: %s", d, err)
+			loc, err = u.start(ctx)
+			if err != nil {
+				return err
+			}
+			offset = 0
+			continue
+		}
+		loc = statusLoc
+		offset = statusOffset
+	}
+	finishUrl, err := url.Parse(loc)
+	if err != nil {
+		return fmt.Errorf("invalid upload location %s: %w", loc, err)
+	}
+	query := finishUrl.Query()
+	query.Set("digest", d.String())
+	finishUrl.RawQuery = query.Encode()
+	resp, err := u.do(ctx, http.MethodPut, finishUrl.String(), nil, nil)
+	if err != nil {
+		return fmt.Errorf("error finishing upload of blob %s: %w", d, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("error finishing upload of blob %s: registry responded %s", d, resp.Status)
+	}
+	return nil
+}
+
+// Upload blobs larger than the chunk size that the dest doesn't have yet in
+// chunks, before the rest of the image is pushed. Returns the blobs uploaded.
+func uploadChunkedBlobs(ctx context.Context, sysCtx *types.SystemContext, named reference.Named, dest ConfigDest, retryDelay time.Duration, layoutDir dinkerlib.AbsPath, blobs []types.BlobInfo) ([]types.BlobInfo, error) {
+	uploaded := []types.BlobInfo{}
+	var u *chunkedUploader
+	for _, b := range blobs {
+		if b.Size <= dest.ChunkSize {
+			continue
+		}
+		if u == nil {
+			var err error
+			u, err = newChunkedUploader(ctx, sysCtx, named, dest.Http, dest.ChunkSize, dest.Retries, retryDelay)
+			if err != nil {
+				return uploaded, err
+			}
+			ctx = remotesdocker.WithScope(ctx, fmt.Sprintf("repository:%s:pull,push", reference.Path(named)))
+		}
+		exists, err := u.exists(ctx, b.Digest)
+		if err != nil {
+			return uploaded, err
+		}
+		if exists {
+			continue
+		}
+		logVerbose("Uploading %s (%d bytes) in chunks", b.Digest, b.Size)
+		if err := u.upload(ctx, layoutDir.Join("blobs").Join(b.Digest.Algorithm().String()).Join(b.Digest.Encoded()), b.Digest, b.Size); err != nil {
+			return uploaded, err
+		}
+		uploaded = append(uploaded, b)
+	}
+	return uploaded, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/platforms"
+	imagecopy "github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/docker/archive"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/types"
+)
+
+const containerdDefaultAddress = "/run/containerd/containerd.sock"
+const containerdDefaultNamespace = "default"
+
+// Import the image at `sourceRef` into containerd's image store as `name`, via
+// a temporary docker-archive
+func pushContainerd(ctx context.Context, policyContext *signature.PolicyContext, sourceRef types.ImageReference, name string, address string, namespace string) error {
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return fmt.Errorf("invalid containerd image name %s: %w", name, err)
+	}
+	tagged, ok := reference.TagNameOnly(named).(reference.NamedTagged)
+	if !ok {
+		return fmt.Errorf("containerd image name %s must have a tag, not a digest", name)
+	}
+	if address == "" {
+		address = containerdDefaultAddress
+	}
+	if namespace == "" {
+		namespace = containerdDefaultNamespace
+	}
+
+	tempDir, err := os.MkdirTemp("", ".dinker-containerd-*")
+	if err != nil {
+		return fmt.Errorf("unable to create temp dir for containerd import: %w", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			log.Printf("Error deleting temp containerd import dir at %s: %s", tempDir, err)
+		}
+	}()
+	archivePath := filepath.Join(tempDir, "image.tar")
+	archiveRef, err := archive.NewReference(archivePath, tagged)
+	if err != nil {
+		return fmt.Errorf("error creating temp archive reference for containerd import: %w", err)
+	}
+	_, err = imagecopy.Image(
+		ctx,
+		policyContext,
+		archiveRef,
+		sourceRef,
+		&imagecopy.Options{
+			ForceManifestMIMEType: manifest.DockerV2Schema2MediaType,
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("error writing temp archive for containerd import: %w", err)
+	}
+
+	client, err := containerd.New(address, containerd.WithDefaultNamespace(namespace))
+	if err != nil {
+		return fmt.Errorf("error connecting to containerd at %s: %w", address, err)
+	}
+	defer client.Close()
+	archiveFile, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("error opening temp archive for containerd import: %w", err)
+	}
+	defer archiveFile.Close()
+	// Import regardless of the host platform, since the image may be built for a
+	// different architecture
+	images, err := client.Import(ctx, archiveFile, containerd.WithAllPlatforms(true))
+	if err != nil {
+		return fmt.Errorf("error importing image into containerd: %w", err)
+	}
+	for _, image := range images {
+		if err := containerd.NewImageWithPlatform(client, image, platforms.All).Unpack(ctx, ""); err != nil {
+			return fmt.Errorf("error unpacking image %s in containerd: %w", image.Name, err)
+		}
+	}
+	return nil
+}
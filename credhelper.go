@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/containers/image/v5/types"
+	"github.com/docker/docker-credential-helpers/client"
+	"github.com/docker/docker-credential-helpers/credentials"
+	"github.com/godbus/dbus/v5"
+)
+
+// The keys credentials for `host` may be stored under, in the order to try them.
+// The docker cli stores docker hub credentials under the v1 index url and
+// others under the host name.
+func credentialKeys(host string) []string {
+	if host == "docker.io" {
+		return []string{"https://index.docker.io/v1/", "docker.io", "registry-1.docker.io"}
+	}
+	return []string{host, "https://" + host}
+}
+
+// The docker cli uses this user name for identity tokens
+const identityTokenUser = "<token>"
+
+func credsToAuth(user string, secret string) *types.DockerAuthConfig {
+	if user == identityTokenUser {
+		return &types.DockerAuthConfig{IdentityToken: secret}
+	}
+	return &types.DockerAuthConfig{
+		Username: user,
+		Password: secret,
+	}
+}
+
+// Get credentials from a docker credential helper program
+// (`docker-credential-NAME`, ex: `ecr-login`, `osxkeychain`, `pass`)
+func credentialHelperAuth(helper string, host string) (*types.DockerAuthConfig, error) {
+	program := client.NewShellProgramFunc("docker-credential-" + helper)
+	for _, key := range credentialKeys(host) {
+		creds, err := client.Get(program, key)
+		if credentials.IsErrCredentialsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error getting credentials for %s from credential helper docker-credential-%s: %w", host, helper, err)
+		}
+		return credsToAuth(creds.Username, creds.Secret), nil
+	}
+	return nil, fmt.Errorf("credential helper docker-credential-%s has no credentials for %s", helper, host)
+}
+
+const secretServiceName = "org.freedesktop.secrets"
+
+// Get credentials from the freedesktop secret service (ex: gnome-keyring,
+// KWallet), stored in the same format as `docker-credential-secretservice`
+func secretServiceAuth(host string) (*types.DockerAuthConfig, error) {
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to the dbus session bus for the secret service: %w", err)
+	}
+	service := conn.Object(secretServiceName, "/org/freedesktop/secrets")
+	var sessionOutput dbus.Variant
+	var session dbus.ObjectPath
+	if err := service.Call("org.freedesktop.Secret.Service.OpenSession", 0, "plain", dbus.MakeVariant("")).Store(&sessionOutput, &session); err != nil {
+		return nil, fmt.Errorf("error opening secret service session: %w", err)
+	}
+	defer conn.Object(secretServiceName, session).Call("org.freedesktop.Secret.Session.Close", 0)
+	for _, key := range credentialKeys(host) {
+		var unlocked, locked []dbus.ObjectPath
+		if err := service.Call("org.freedesktop.Secret.Service.SearchItems", 0, map[string]string{"server": key}).Store(&unlocked, &locked); err != nil {
+			return nil, fmt.Errorf("error searching secret service for %s: %w", key, err)
+		}
+		if len(unlocked) == 0 && len(locked) != 0 {
+			var prompt dbus.ObjectPath
+			if err := service.Call("org.freedesktop.Secret.Service.Unlock", 0, locked).Store(&unlocked, &prompt); err != nil {
+				return nil, fmt.Errorf("error unlocking secret service item for %s: %w", key, err)
+			}
+			if len(unlocked) == 0 {
+				return nil, fmt.Errorf("secret service credentials for %s are locked, unlock the keyring first", key)
+			}
+		}
+		if len(unlocked) == 0 {
+			continue
+		}
+		item := conn.Object(secretServiceName, unlocked[0])
+		attrsVariant, err := item.GetProperty("org.freedesktop.Secret.Item.Attributes")
+		if err != nil {
+			return nil, fmt.Errorf("error reading secret service item attributes for %s: %w", key, err)
+		}
+		attrs, _ := attrsVariant.Value().(map[string]string)
+		var secret struct {
+			Session     dbus.ObjectPath
+			Parameters  []byte
+			Value       []byte
+			ContentType string
+		}
+		if err := item.Call("org.freedesktop.Secret.Item.GetSecret", 0, session).Store(&secret); err != nil {
+			return nil, fmt.Errorf("error reading secret service secret for %s: %w", key, err)
+		}
+		return credsToAuth(attrs["username"], string(secret.Value)), nil
+	}
+	return nil, fmt.Errorf("secret service has no credentials for %s", host)
+}
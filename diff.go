@@ -0,0 +1,304 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// A layer at the same position in both images
+type DiffLayer struct {
+	Index int `json:"index"`
+	// Missing if the image has fewer layers
+	A digest.Digest `json:"a,omitempty"`
+	B digest.Digest `json:"b,omitempty"`
+	// One of same, changed, added (only in b), or removed (only in a)
+	Status string `json:"status"`
+}
+
+// A config field (or env var, label, port, etc.) that differs. A or B is
+// missing if the field is only set in one of the images.
+type DiffConfigField struct {
+	Field string  `json:"field"`
+	A     *string `json:"a,omitempty"`
+	B     *string `json:"b,omitempty"`
+}
+
+type DiffFiles struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	// Content, mode, owner, or link target changed
+	Changed []string `json:"changed"`
+}
+
+// Printed by `dinker diff`
+type DiffResult struct {
+	A    string `json:"a"`
+	B    string `json:"b"`
+	Same bool   `json:"same"`
+	// Of the (platform) image manifests
+	ADigest digest.Digest     `json:"a_digest"`
+	BDigest digest.Digest     `json:"b_digest"`
+	Layers  []DiffLayer       `json:"layers"`
+	Config  []DiffConfigField `json:"config"`
+	// Only with --files
+	Files *DiffFiles `json:"files,omitempty"`
+}
+
+// Flatten the comparable parts of the config to field -> value, with an entry
+// per env var, label, etc. so changes are reported individually
+func flattenImageConfig(config *imagespec.Image) map[string]string {
+	out := map[string]string{}
+	set := func(k string, v string) {
+		if v != "" {
+			out[k] = v
+		}
+	}
+	setJson := func(k string, v []string) {
+		if len(v) == 0 {
+			return
+		}
+		j, err := json.Marshal(v)
+		if err != nil {
+			panic(err)
+		}
+		out[k] = string(j)
+	}
+	set("architecture", config.Architecture)
+	set("os", config.OS)
+	set("variant", config.Variant)
+	if config.Created != nil {
+		set("created", config.Created.UTC().Format(time.RFC3339Nano))
+	}
+	set("user", config.Config.User)
+	set("working_dir", config.Config.WorkingDir)
+	set("stop_signal", config.Config.StopSignal)
+	setJson("entrypoint", config.Config.Entrypoint)
+	setJson("cmd", config.Config.Cmd)
+	for _, e := range config.Config.Env {
+		k, v, _ := strings.Cut(e, "=")
+		out["env."+k] = v
+	}
+	for k, v := range config.Config.Labels {
+		out["labels."+k] = v
+	}
+	for k := range config.Config.ExposedPorts {
+		out["exposed_ports."+k] = "true"
+	}
+	for k := range config.Config.Volumes {
+		out["volumes."+k] = "true"
+	}
+	return out
+}
+
+func diffConfigs(a *imagespec.Image, b *imagespec.Image) []DiffConfigField {
+	aFields := flattenImageConfig(a)
+	bFields := flattenImageConfig(b)
+	keys := []string{}
+	for k := range aFields {
+		keys = append(keys, k)
+	}
+	for k := range bFields {
+		if _, found := aFields[k]; !found {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	out := []DiffConfigField{}
+	for _, k := range keys {
+		aValue, aFound := aFields[k]
+		bValue, bFound := bFields[k]
+		if aFound && bFound && aValue == bValue {
+			continue
+		}
+		field := DiffConfigField{Field: k}
+		if aFound {
+			field.A = &aValue
+		}
+		if bFound {
+			field.B = &bValue
+		}
+		out = append(out, field)
+	}
+	return out
+}
+
+func diffLayers(a []imagespec.Descriptor, b []imagespec.Descriptor) []DiffLayer {
+	out := []DiffLayer{}
+	for i := 0; i < len(a) || i < len(b); i++ {
+		l := DiffLayer{Index: i}
+		switch {
+		case i >= len(a):
+			l.B = b[i].Digest
+			l.Status = "added"
+		case i >= len(b):
+			l.A = a[i].Digest
+			l.Status = "removed"
+		default:
+			l.A = a[i].Digest
+			l.B = b[i].Digest
+			if l.A == l.B {
+				l.Status = "same"
+			} else {
+				l.Status = "changed"
+			}
+		}
+		out = append(out, l)
+	}
+	return out
+}
+
+// The parts of a file that are compared
+type diffFileEntry struct {
+	typeflag byte
+	mode     int64
+	uid      int
+	gid      int
+	linkname string
+	content  digest.Digest
+}
+
+func cleanTarPath(p string) string {
+	return strings.Trim(path.Clean("/"+p), "/")
+}
+
+// Apply a layer tar to the file map, including whiteouts
+func applyDiffLayer(files map[string]diffFileEntry, r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading layer tar: %w", err)
+		}
+		p := cleanTarPath(h.Name)
+		dir, name := path.Split(p)
+		dir = strings.TrimSuffix(dir, "/")
+		removeUnder := func(parent string) {
+			for k := range files {
+				if parent == "" || strings.HasPrefix(k, parent+"/") {
+					delete(files, k)
+				}
+			}
+		}
+		if name == ".wh..wh..opq" {
+			removeUnder(dir)
+			continue
+		}
+		if strings.HasPrefix(name, ".wh.") {
+			target := path.Join(dir, strings.TrimPrefix(name, ".wh."))
+			delete(files, target)
+			removeUnder(target)
+			continue
+		}
+		entry := diffFileEntry{
+			typeflag: h.Typeflag,
+			mode:     h.Mode,
+			uid:      h.Uid,
+			gid:      h.Gid,
+			linkname: h.Linkname,
+		}
+		if h.Typeflag == tar.TypeReg {
+			digester := digest.Canonical.Digester()
+			if _, err := io.Copy(digester.Hash(), tr); err != nil {
+				return fmt.Errorf("error reading layer file %s: %w", p, err)
+			}
+			entry.content = digester.Digest()
+		}
+		if old, found := files[p]; found && old.typeflag == tar.TypeDir && h.Typeflag != tar.TypeDir {
+			removeUnder(p)
+		}
+		files[p] = entry
+	}
+}
+
+// Read the combined filesystem of an image's layers
+func readDiffFiles(ctx context.Context, sysCtx *types.SystemContext, target string, layers []imagespec.Descriptor) (map[string]diffFileEntry, error) {
+	files := map[string]diffFileEntry{}
+	if err := readImageLayers(ctx, sysCtx, target, layers, func(r io.Reader) error {
+		return applyDiffLayer(files, r)
+	}); err != nil {
+		return nil, err
+	}
+	delete(files, "")
+	return files, nil
+}
+
+func diffFiles(a map[string]diffFileEntry, b map[string]diffFileEntry) *DiffFiles {
+	out := &DiffFiles{
+		Added:   []string{},
+		Removed: []string{},
+		Changed: []string{},
+	}
+	for k, aEntry := range a {
+		bEntry, found := b[k]
+		if !found {
+			out.Removed = append(out.Removed, "/"+k)
+		} else if aEntry != bEntry {
+			out.Changed = append(out.Changed, "/"+k)
+		}
+	}
+	for k := range b {
+		if _, found := a[k]; !found {
+			out.Added = append(out.Added, "/"+k)
+		}
+	}
+	sort.Strings(out.Added)
+	sort.Strings(out.Removed)
+	sort.Strings(out.Changed)
+	return out
+}
+
+// Compare two images and print the differences as json
+func diffCommand(ctx context.Context, sysCtx *types.SystemContext, a string, b string, files bool) error {
+	aImage, err := inspectImage(ctx, sysCtx, a)
+	if err != nil {
+		return err
+	}
+	bImage, err := inspectImage(ctx, sysCtx, b)
+	if err != nil {
+		return err
+	}
+	result := DiffResult{
+		A:       a,
+		B:       b,
+		Same:    aImage.ManifestDigest == bImage.ManifestDigest,
+		ADigest: aImage.ManifestDigest,
+		BDigest: bImage.ManifestDigest,
+		Layers:  diffLayers(aImage.Layers, bImage.Layers),
+		Config:  diffConfigs(aImage.Config, bImage.Config),
+	}
+	if files {
+		aFiles, err := readDiffFiles(ctx, sysCtx, a, aImage.Layers)
+		if err != nil {
+			return err
+		}
+		bFiles, err := readDiffFiles(ctx, sysCtx, b, bImage.Layers)
+		if err != nil {
+			return err
+		}
+		result.Files = diffFiles(aFiles, bFiles)
+	}
+	out, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	if _, err := fmt.Fprintln(os.Stdout, string(out)); err != nil {
+		return fmt.Errorf("error writing diff result: %w", err)
+	}
+	return nil
+}
@@ -1,54 +1,358 @@
 package dinkerlib
 
+import (
+	"context"
+	"io"
+	"io/fs"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
 type BuildImageArgsDir struct {
-	// Name in parent in destination tree
+	// Name in parent in destination tree. Defaults to filename of source if empty.
 	Name string `json:"name"`
+	// Optional, path of dir to copy from. All files and dirs within are copied recursively.
+	Source AbsPath `json:"source"`
+	// Optional, instead of source copy from a checkout of a git repo (without
+	// `.git`). Name is required in this case.
+	Git *BuildImageArgsGit `json:"git"`
+	// Optional, patterns of paths within source to skip (ex: `**/*.o`, `.git`).
+	// Patterns are relative to source, `**` matches any number of dirs, and
+	// other parts are matched with path.Match. Skipping a dir skips its contents.
+	Exclude []string `json:"exclude"`
 	// Parsed as octal, defaults to 0755
 	Mode string `json:"mode"`
+	// Owner, defaults to 0 (root). Also applies to everything copied from source.
+	Uid int `json:"uid"`
+	Gid int `json:"gid"`
+	// Symbolic owner, optional. Also applies to everything copied from source.
+	Uname string `json:"uname"`
+	Gname string `json:"gname"`
+	// Use the numeric owner of the source instead of uid and gid, for it and
+	// everything copied from it
+	PreserveOwner bool `json:"preserve_owner"`
 	// Child dirs
-	Dirs []BuildImageArgsDir
+	Dirs []BuildImageArgsDir `json:"dirs"`
 	// Child files
-	Files []BuildImageArgsFile
+	Files []BuildImageArgsFile `json:"files"`
+	// Child device nodes and fifos
+	Devices []BuildImageArgsDevice `json:"devices"`
+}
+
+type BuildImageArgsGit struct {
+	// Repo to clone, anything `git fetch` accepts
+	Url string `json:"url"`
+	// Commit, tag, or branch to check out. Use a commit for reproducible builds.
+	Ref string `json:"ref"`
+	// Optional, a dir in the repo to copy instead of the whole repo
+	Path string `json:"path"`
 }
 
 type BuildImageArgsFile struct {
 	// Name in parent in destination tree. Defaults to filename of source if empty.
 	Name string `json:"name"`
-	// Path of file to copy from
+	// Path of file to copy from, exclusive with template. May be a glob (see
+	// filepath.Match) matching multiple files, in which case name must be empty.
+	// May also be an http or https url to download, which requires sha256.
 	Source AbsPath `json:"source"`
+	// The expected sha256 (hex) of a url source
+	Sha256 string `json:"sha256"`
+	// Optional, sources to use instead of source for specific platforms. Keys are
+	// `os/arch/variant`, `os/arch`, or `arch` (ex: `arm64`, `linux/arm/v7`), with the
+	// most specific match used. Falls back to source if no key matches.
+	PlatformSources map[string]AbsPath `json:"platform_sources"`
+	// Instead of copying, render this file as a text/template with TemplateData. Name
+	// defaults to the template filename.
+	Template AbsPath `json:"template"`
+	// Instead of copying from source, hardlink to this other file added in the layer
+	// (path in destination tree). Name is required in this case.
+	HardLink string `json:"hard_link"`
+	// Optional, a command to run on a temp copy of the source before adding it (ex:
+	// `["strip", "--strip-all"]`). The path of the copy is appended to the
+	// arguments and the command should modify it in place.
+	Process []string `json:"process"`
 	// Parsed as octal, defaults to 0644
 	Mode string `json:"mode"`
+	// Owner, defaults to 0 (root)
+	Uid int `json:"uid"`
+	Gid int `json:"gid"`
+	// Symbolic owner, optional
+	Uname string `json:"uname"`
+	Gname string `json:"gname"`
+	// Use the numeric owner of the source (or template) instead of uid and gid
+	PreserveOwner bool `json:"preserve_owner"`
+	// If the source is a dynamically linked ELF binary, also add the dynamic linker
+	// and shared libraries it needs (recursively) from the host, at their host
+	// paths
+	IncludeLibs bool `json:"include_libs"`
+}
+
+type BuildImageArgsDevice struct {
+	// Name in parent in destination tree
+	Name string `json:"name"`
+	// `char`, `block`, or `fifo`
+	Type string `json:"type"`
+	// Device numbers, ignored for fifos
+	Major int64 `json:"major"`
+	Minor int64 `json:"minor"`
+	// Parsed as octal, defaults to 0666
+	Mode string `json:"mode"`
+	// Owner, defaults to 0 (root)
+	Uid int `json:"uid"`
+	Gid int `json:"gid"`
+	// Symbolic owner, optional
+	Uname string `json:"uname"`
+	Gname string `json:"gname"`
+}
+
+type BuildImageArgsLayer struct {
+	// Existing tar or tar.gz file to add as the layer as-is. Exclusive with other
+	// fields.
+	Tar AbsPath `json:"tar"`
+	// Directories to build in the image root
+	Dirs []BuildImageArgsDir `json:"dirs"`
+	// Files to add to the image root
+	Files []BuildImageArgsFile `json:"files"`
+	// Device nodes and fifos to add to the image root
+	Devices []BuildImageArgsDevice `json:"devices"`
+	// Paths of files or dirs in lower layers to delete (via whiteout entries)
+	Remove []string `json:"remove"`
+	// Nix store paths (ex: the `result` link from `nix build`) to add, with their
+	// runtime closures, at their paths in /nix/store
+	Nix []AbsPath `json:"nix"`
+	// Add a CA certificate bundle at /etc/ssl/certs/ca-certificates.crt
+	IncludeCaCerts bool `json:"include_ca_certs"`
+	// The CA bundle to add on the host, defaults to the bundled Mozilla CA
+	// certificates
+	CaCertsSource AbsPath `json:"ca_certs_source"`
+}
+
+// Available to file templates
+type TemplateData struct {
+	Arch    string
+	Os      string
+	Variant string
+	// Final image environment, after inheriting and adding
+	Env    map[string]string
+	Labels map[string]string
 }
 
 type BuildImageArgsPort struct {
 	Port int `json:"port"`
+	// Instead of port, an inclusive range of ports (ex: `8000-8010`)
+	PortRange string `json:"port_range"`
 	// `tcp` or `udp`, defaults to `tcp`
 	Transport string `json:"transport"`
 }
 
+type BuildImageArgsPlatform struct {
+	// Defaults to the architecture, os, etc. in BuildImageArgs
+	Architecture string   `json:"arch"`
+	Os           string   `json:"os"`
+	Variant      string   `json:"variant"`
+	OsVersion    string   `json:"os_version"`
+	OsFeatures   []string `json:"os_features"`
+	// Optional, FROM image for this platform, overrides FromPath in BuildImageArgs
+	FromPath AbsPath `json:"from"`
+	// Optional, rootfs tar for this platform, overrides FromRootfs in BuildImageArgs
+	FromRootfs AbsPath `json:"from_rootfs"`
+}
+
+// Package metadata to include in the SBOM
+type BuildImageArgsSbomPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	// SPDX license expression (ex: `MIT OR Apache-2.0`)
+	License string `json:"license"`
+	// Package url (ex: `pkg:cargo/serde@1.0.0`)
+	Purl string `json:"purl"`
+}
+
+type BuildEventKind int
+
+const (
+	// Starting to build the image for a platform (only with multiple platforms)
+	BuildEventPlatform BuildEventKind = iota
+	// Starting to build a new layer from files
+	BuildEventLayerStart
+	// A file was added to the layer being built
+	BuildEventFile
+	// A layer was written to the image, either from another image or built
+	BuildEventLayer
+	// The image manifest was written
+	BuildEventDone
+)
+
+// Build progress, passed to OnEvent
+type BuildEvent struct {
+	Kind BuildEventKind
+	// For BuildEventPlatform, ex: `linux/arm64`
+	Platform string
+	// For BuildEventFile, the path in the image
+	Path string
+	// For BuildEventLayer the layer digest, for BuildEventDone the manifest digest
+	Digest digest.Digest
+	// Size in bytes of the file or layer
+	Size int64
+}
+
+// Receives a built image directly, instead of writing it to an OCI layout. Each
+// new layer is still built in a temp file first, since its digest has to be
+// known before it's sent.
+type ImageDest interface {
+	// Called for every blob before the manifest. The reader may not be read to the
+	// end (ex: if the destination already has the blob).
+	PutBlob(ctx context.Context, digest digest.Digest, size int64, contents io.Reader, isConfig bool) error
+	PutManifest(ctx context.Context, manifest []byte) error
+}
+
+// Receives warnings about non-fatal problems during the build (ex: failing to
+// clean up temp files). `*log.Logger` implements this.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
 type BuildImageArgs struct {
-	// optional, if zero then "scratch" (no base layers, need Architecture and Os below)
+	// optional, if zero then "scratch" (no base layers, need Architecture and Os below).
+	// An oci-archive or docker-archive (`docker save`) tar file.
 	FromPath AbsPath
-	// Defaults to FROM image architecture
+	// Optional, instead of FromPath a tar, tar.gz, or tar.zst of a root filesystem
+	// (ex: from debootstrap) to add as the base layer of a scratch image
+	FromRootfs AbsPath
+	// Defaults to FROM image architecture. If FROM has images for multiple platforms,
+	// this, Os and Variant select which to use.
 	Architecture string
 	// Defaults to FROM image os
 	Os string
+	// Architecture variant (ex: `v7` for arm), defaults to FROM image variant
+	Variant string
+	// OS version (ex: `10.0.17763.1879` for Windows), defaults to FROM image os
+	// version. Also used to select from multiple FROM images.
+	OsVersion string
+	// Required OS features (ex: `win32k` for Windows), defaults to FROM image os
+	// features
+	OsFeatures []string
+	// If specified, build an image for each platform with the other arguments and an
+	// index referencing them
+	Platforms []BuildImageArgsPlatform
+	// Oci-archive images whose layers are added above FROM layers (and below all other
+	// layers). Their configs are ignored.
+	CopyFrom []AbsPath
+	// Additional layers, above FROM layers and below the layer built from the fields
+	// below
+	Layers []BuildImageArgsLayer
 	// Directories to build in the image root
 	Dirs []BuildImageArgsDir
 	// Files to add to the image root
 	Files []BuildImageArgsFile
+	// Device nodes and fifos to add to the image root
+	Devices []BuildImageArgsDevice
+	// Paths of files or dirs in FROM image to delete (via whiteout entries)
+	Remove []string
+	// Nix store paths to add with their runtime closures
+	Nix []AbsPath
+	// Add a CA certificate bundle, from CaCertsSource on the host or else the
+	// bundled Mozilla CA certificates
+	IncludeCaCerts bool
+	CaCertsSource  AbsPath
 	// Don't inherit env from FROM image
 	ClearEnv bool
-	AddEnv   map[string]string
+	// Names of env vars not to inherit from FROM image
+	RemoveEnv []string
+	AddEnv    map[string]string
 	// Defaults to FROM image working dir
 	WorkingDir string
+	// Don't inherit working dir from FROM image
+	ClearWorkingDir bool
 	// Defaults to FROM image user
-	User       string
+	User string
+	// Don't inherit user from FROM image
+	ClearUser bool
+	// Add /etc/passwd and /etc/group entries and a home dir for User to the
+	// image root, for images without a FROM image
+	CreateUser *BuildImageArgsCreateUser
+	// Defaults to FROM image entrypoint
 	Entrypoint []string
-	Cmd        []string
-	Ports      []BuildImageArgsPort
+	// Don't inherit entrypoint from FROM image
+	ClearEntrypoint bool
+	// Defaults to FROM image cmd, unless Entrypoint or ClearEntrypoint is specified
+	Cmd []string
+	// Don't inherit cmd from FROM image
+	ClearCmd bool
+	// The shell for shell form commands in later Docker builds (ex: `["/bin/sh",
+	// "-c"]`), defaults to FROM image shell
+	Shell []string
+	// Merged with FROM image ports
+	Ports []BuildImageArgsPort
+	// Don't inherit ports from FROM image
+	ClearPorts bool
+	// Ports not to inherit from FROM image
+	RemovePorts []BuildImageArgsPort
+	// Paths of volumes in the container (ex: `/data`), merged with FROM image
+	// volumes
+	Volumes []string
+	// Don't inherit volumes from FROM image
+	ClearVolumes bool
+	// Paths of volumes not to inherit from FROM image
+	RemoveVolumes []string
+	// Defaults to FROM image stop signal
 	StopSignal string
-	Labels     map[string]string
+	// Don't inherit stop signal from FROM image
+	ClearStopSignal bool
+	// Merged over the FROM image labels
+	Labels map[string]string
+	// Don't inherit labels from FROM image
+	ClearLabels bool
+	// Optional, the image author (ex: name and email)
+	Author string
+	// Annotations for the image manifest (and index with multiple platforms)
+	Annotations map[string]string
+	// Compression of built layers, `gzip` (default), `estargz` (gzip with an index
+	// for lazy pulling), `zstd:chunked` (zstd with chunk metadata for partial
+	// pulls), or `none`
+	Compression string
+	// Number of threads to use for gzip compression, defaults to the number of CPUs
+	CompressionThreads int
+	// Optional, a directory to store compressed built layers in, so layers with
+	// the same contents aren't compressed again in later builds
+	CacheDir AbsPath
+	// Sort layer contents by path regardless of argument order and write all tar
+	// entries in pax format without access/change times
+	Reproducible bool
+	// Merge the FROM, copied, and new layers into a single layer (applying
+	// whiteouts)
+	Squash bool
+	// Optional, split each new layer into multiple layers of at most this many
+	// bytes (uncompressed tar size), keeping files whole
+	MaxLayerSize int64
+	// Optional, image creation time and modification time of everything in the new
+	// layer. If zero, creation time is omitted and files have the unix epoch as mtime.
+	Created time.Time
+	// Optional, set as the subject of the built manifest (or index, with multiple
+	// platforms) so it's listed in the subject's referrers
+	Subject *imagespec.Descriptor
+	// Optional, write an SPDX json SBOM of files added in built layers here. Not
+	// supported with multiple platforms.
+	SbomPath AbsPath
+	// Name of the SBOM document, required with SbomPath
+	SbomName string
+	// Packages to list in the SBOM
+	SbomPackages []BuildImageArgsSbomPackage
+	// Optional, read file, dir, and template sources from this instead of the host
+	// filesystem. Source paths are then paths within it (a leading `/` is ignored).
+	// FROM images and prebuilt layers are still read from the host.
+	SourceFS fs.FS `json:"-"`
+	// Optional, called with progress during the build. Called from the goroutine
+	// BuildImage was called from.
+	OnEvent func(BuildEvent) `json:"-"`
+	// Optional, where to log warnings. Defaults to the standard `log` logger, use
+	// `log.New(io.Discard, "", 0)` to silence them.
+	Logger Logger `json:"-"`
+	// Optional, write the image here instead of to DestDirPath. Not supported with
+	// multiple platforms.
+	Dest ImageDest `json:"-"`
 	/// Where to place the built image as an oci-dir
 	DestDirPath AbsPath
 }
@@ -0,0 +1,44 @@
+package dinkerlib
+
+import (
+	"archive/tar"
+	_ "embed"
+	"fmt"
+	"os"
+	"path"
+)
+
+//go:embed ca-certificates.crt
+var mozillaCaCerts []byte
+
+const caCertsPath = "etc/ssl/certs/ca-certificates.crt"
+
+// Add a CA certificate bundle at the standard path, from `source` on the host or
+// else the bundled Mozilla CA certificates
+func writeCaCerts(dest *destLayer, source AbsPath) error {
+	if err := writeParentDirs(dest, caCertsPath); err != nil {
+		return err
+	}
+	if source == "" {
+		if _, seen := dest.seen[caCertsPath]; seen {
+			return fmt.Errorf("the layer tar file has destination file or dir %s multiple times", caCertsPath)
+		}
+		dest.seen[caCertsPath] = tar.TypeReg
+		return writeDestData(dest, &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     caCertsPath,
+			Mode:     0o644,
+			ModTime:  dest.mtime,
+		}, mozillaCaCerts)
+	}
+	// The bundle is on the host, not in the sources fs
+	parentSources := dest.sources
+	dest.sources = os.DirFS("/")
+	defer func() {
+		dest.sources = parentSources
+	}()
+	return writeDestFile0(dest, path.Dir(caCertsPath), BuildImageArgsFile{
+		Name:   path.Base(caCertsPath),
+		Source: source,
+	})
+}
@@ -0,0 +1,92 @@
+package dinkerlib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/opencontainers/go-digest"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Metadata of a compressed layer in the layer cache
+type cachedLayer struct {
+	Descriptor imagespec.Descriptor `json:"descriptor"`
+	// May differ from the key (ex: estargz adds entries)
+	DiffId digest.Digest `json:"diff_id"`
+}
+
+// Cache entries are keyed by the compression and the digest of the tar dinker
+// built, with the metadata in `KEY.json` and the compressed blob in `KEY.blob`
+func layerCacheKey(cacheDir AbsPath, compression string, tarDigest digest.Digest) AbsPath {
+	return cacheDir.Join(fmt.Sprintf("%s-%s-%s", compression, tarDigest.Algorithm(), tarDigest.Encoded()))
+}
+
+// Look up a layer in the cache, returning nil if it's not there. The caller must
+// close the returned blob.
+func readLayerCache(cacheDir AbsPath, compression string, tarDigest digest.Digest) (*cachedLayer, *os.File, error) {
+	key := layerCacheKey(cacheDir, compression, tarDigest)
+	metaJson, err := os.ReadFile(key.Raw() + ".json")
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading layer cache entry %s: %w", key, err)
+	}
+	var meta cachedLayer
+	if err := json.Unmarshal(metaJson, &meta); err != nil {
+		return nil, nil, fmt.Errorf("error parsing layer cache entry %s: %w", key, err)
+	}
+	blob, err := os.Open(key.Raw() + ".blob")
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening layer cache blob %s: %w", key, err)
+	}
+	stat, err := blob.Stat()
+	if err != nil || stat.Size() != meta.Descriptor.Size {
+		// Partially written or damaged, rebuild it
+		blob.Close()
+		return nil, nil, nil
+	}
+	return &meta, blob, nil
+}
+
+// Add a layer to the cache. Files are written to temp names and renamed so
+// concurrent builds never see partial entries.
+func writeLayerCache(cacheDir AbsPath, compression string, tarDigest digest.Digest, meta cachedLayer, blob io.Reader) error {
+	if err := os.MkdirAll(cacheDir.Raw(), 0o755); err != nil {
+		return fmt.Errorf("error creating layer cache dir %s: %w", cacheDir, err)
+	}
+	key := layerCacheKey(cacheDir, compression, tarDigest)
+	writeAtomic := func(suffix string, contents io.Reader) error {
+		tmp, err := os.CreateTemp(cacheDir.Raw(), ".tmp-*")
+		if err != nil {
+			return fmt.Errorf("error creating temp file in layer cache dir %s: %w", cacheDir, err)
+		}
+		_, err = io.Copy(tmp, contents)
+		if err1 := tmp.Close(); err == nil {
+			err = err1
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), key.Raw()+suffix)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			return fmt.Errorf("error writing layer cache entry %s%s: %w", key, suffix, err)
+		}
+		return nil
+	}
+	if err := writeAtomic(".blob", blob); err != nil {
+		return err
+	}
+	metaJson, err := json.Marshal(meta)
+	if err != nil {
+		panic(err)
+	}
+	// Metadata last, since entries without it are ignored
+	return writeAtomic(".json", bytes.NewReader(metaJson))
+}
@@ -2,20 +2,33 @@ package dinkerlib
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"io/ioutil"
 	"log"
 	"os"
+	"path"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
+	"text/template"
+	"time"
 
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containers/storage/pkg/chunked/compressor"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
 	tarfs "github.com/nlepage/go-tarfs"
 	"github.com/opencontainers/go-digest"
 	"github.com/opencontainers/image-spec/specs-go"
@@ -38,6 +51,93 @@ func readTarFsJson[T any](tfs fs.FS, p string) (out T, err error) {
 	return
 }
 
+func blobPath(digest digest.Digest) string {
+	return fmt.Sprintf("blobs/%s/%s", digest.Algorithm().String(), digest.Hex())
+}
+
+// Find image manifests in an oci layout index, including in nested indexes
+func listManifests(tfs fs.FS, index imagespec.Index) ([]imagespec.Descriptor, error) {
+	out := []imagespec.Descriptor{}
+	for _, m := range index.Manifests {
+		switch m.MediaType {
+		case imagespec.MediaTypeImageManifest:
+			out = append(out, m)
+		case imagespec.MediaTypeImageIndex:
+			subindex, err := readTarFsJson[imagespec.Index](tfs, blobPath(m.Digest))
+			if err != nil {
+				return nil, fmt.Errorf("unable to find index %s referenced in tar index: %w", m.Digest, err)
+			}
+			submanifests, err := listManifests(tfs, subindex)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, submanifests...)
+		}
+	}
+	return out, nil
+}
+
+// Pick the image manifest matching the platform from an oci layout index. Empty
+// platform fields match anything.
+func selectManifest(tfs fs.FS, index imagespec.Index, arch string, os_ string, variant string, osVersion string) (imagespec.Descriptor, error) {
+	manifests, err := listManifests(tfs, index)
+	if err != nil {
+		return imagespec.Descriptor{}, err
+	}
+	if len(manifests) == 1 {
+		return manifests[0], nil
+	}
+	for i, m := range manifests {
+		if m.Platform != nil {
+			continue
+		}
+		// Not in the index, get the platform from the image config
+		manifest, err := readTarFsJson[imagespec.Manifest](tfs, blobPath(m.Digest))
+		if err != nil {
+			return imagespec.Descriptor{}, fmt.Errorf("unable to find manifest %s referenced in tar index: %w", m.Digest, err)
+		}
+		config, err := readTarFsJson[imagespec.Image](tfs, blobPath(manifest.Config.Digest))
+		if err != nil {
+			return imagespec.Descriptor{}, fmt.Errorf("unable to find config %s referenced in image manifest: %w", manifest.Config.Digest, err)
+		}
+		manifests[i].Platform = &config.Platform
+	}
+	matches := []imagespec.Descriptor{}
+	for _, m := range manifests {
+		if arch != "" && m.Platform.Architecture != arch {
+			continue
+		}
+		if os_ != "" && m.Platform.OS != os_ {
+			continue
+		}
+		if variant != "" && m.Platform.Variant != variant {
+			continue
+		}
+		if osVersion != "" && m.Platform.OSVersion != osVersion {
+			continue
+		}
+		matches = append(matches, m)
+	}
+	if len(matches) == 1 {
+		return matches[0], nil
+	}
+	available := []string{}
+	for _, m := range manifests {
+		available = append(available, strings.TrimSuffix(fmt.Sprintf("%s/%s/%s", m.Platform.OS, m.Platform.Architecture, m.Platform.Variant), "/"))
+	}
+	if len(matches) == 0 {
+		return imagespec.Descriptor{}, fmt.Errorf("no image in the index matches platform os [%s] arch [%s] variant [%s]; available platforms are: %s", os_, arch, variant, strings.Join(available, ", "))
+	}
+	return imagespec.Descriptor{}, fmt.Errorf("multiple images in the index match platform os [%s] arch [%s] variant [%s], specify more platform fields to choose one; available platforms are: %s", os_, arch, variant, strings.Join(available, ", "))
+}
+
+// An element of manifest.json in a `docker save` archive
+type dockerArchiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
 func canonicalJsonMarshal(sym any) []byte {
 	ser, err := json.Marshal(sym)
 	if err != nil {
@@ -57,42 +157,397 @@ func canonicalJsonMarshal(sym any) []byte {
 	return ser
 }
 
-func writeDestFile(destFilesSeen map[string]bool, destTar *tar.Writer, parentPath string, f BuildImageArgsFile) error {
-	if strings.Contains(f.Name, "/") {
-		return fmt.Errorf("Dir %s name contains slashes; subdirs must be nested as objects", f.Name)
+// State for the layer being built
+type destLayer struct {
+	tar *tar.Writer
+	// Type of each path written to the layer so far (tar type flag or
+	// seenWhiteout)
+	seen map[string]byte
+	// Hardlinks, written after everything else so their targets exist
+	links []*tar.Header
+	// Passed to file templates when rendering
+	templateData TemplateData
+	// Modification time of all entries
+	mtime time.Time
+	// Regular files added, if generating an SBOM
+	sbomFiles *[]sbomFile
+	// Normalize headers
+	reproducible bool
+	ctx          context.Context
+	onEvent      func(BuildEvent)
+	// File, dir, and template sources are read from here
+	sources fs.FS
+	// Url sources are downloaded here if specified, otherwise to temp files
+	cacheDir AbsPath
+	// Host shared libraries needed by files with `include_libs`, written after
+	// everything else
+	libs map[string]bool
+	// Source dirs being copied, to detect symlink loops
+	sourceDirs map[dirId]bool
+	// Paths and their types in the layers below, from FROM and prebuilt layers
+	lowerPaths func() (map[string]byte, error)
+}
+
+// The path of a source in the sources fs
+func sourcePath(p AbsPath) string {
+	return Def(strings.TrimPrefix(path.Clean(filepath.ToSlash(p.Raw())), "/"), ".")
+}
+
+// True if the source should be expanded as a glob. Paths with glob
+// metacharacters that exist as is (ex: `report[1].txt`) are used literally.
+func isGlobSource(fsys fs.FS, p AbsPath) bool {
+	if !p.IsGlob() {
+		return false
+	}
+	_, err := fs.Stat(fsys, sourcePath(p))
+	return err != nil
+}
+
+// Mode value to use the mode of the source
+const modePreserve = "preserve"
+
+// Parse an octal mode (or `def` if empty), or take it from `source` if it's
+// `preserve`
+func resolveMode(mode string, def string, sources fs.FS, source AbsPath) (int64, error) {
+	if mode != modePreserve {
+		return strconv.ParseInt(Def(mode, def), 8, 32)
+	}
+	if source == "" || source.IsUrl() {
+		return 0, fmt.Errorf("mode preserve requires a local source")
+	}
+	stat, err := fs.Stat(sources, sourcePath(source))
+	if err != nil {
+		return 0, fmt.Errorf("error looking up mode of %s: %w", source, err)
+	}
+	out := int64(stat.Mode().Perm())
+	if stat.Mode()&fs.ModeSetuid != 0 {
+		out |= 0o4000
+	}
+	if stat.Mode()&fs.ModeSetgid != 0 {
+		out |= 0o2000
+	}
+	if stat.Mode()&fs.ModeSticky != 0 {
+		out |= 0o1000
+	}
+	return out, nil
+}
+
+// Get the owner from `source` if `preserve`, otherwise use uid and gid
+func resolveOwner(preserve bool, uid int, gid int, sources fs.FS, source AbsPath) (int, int, error) {
+	if !preserve {
+		return uid, gid, nil
+	}
+	if source == "" || source.IsUrl() {
+		return 0, 0, fmt.Errorf("preserve_owner requires a local source")
+	}
+	stat, err := fs.Stat(sources, sourcePath(source))
+	if err != nil {
+		return 0, 0, fmt.Errorf("error looking up owner of %s: %w", source, err)
+	}
+	sys, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, fmt.Errorf("owner of %s isn't available", source)
+	}
+	return int(sys.Uid), int(sys.Gid), nil
+}
+
+// Identifies a dir on the host, to detect symlink loops
+type dirId struct {
+	dev uint64
+	ino uint64
+}
+
+// False if the fs doesn't provide the device and inode (so can't have symlinks to
+// dirs on the host)
+func statDirId(info fs.FileInfo) (dirId, bool) {
+	sys, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return dirId{}, false
+	}
+	return dirId{dev: uint64(sys.Dev), ino: uint64(sys.Ino)}, true
+}
+
+// Record entering a source dir, failing if it's already being copied (a symlink
+// to one of its parents). The returned function records leaving it.
+func enterSourceDir(ancestors map[dirId]bool, info fs.FileInfo, source AbsPath) (func(), error) {
+	id, ok := statDirId(info)
+	if !ok {
+		return func() {}, nil
+	}
+	if ancestors[id] {
+		return nil, fmt.Errorf("source dir %s is inside itself (symlink loop)", source)
+	}
+	ancestors[id] = true
+	return func() {
+		delete(ancestors, id)
+	}, nil
+}
+
+func (dest *destLayer) writeHeader(h *tar.Header) error {
+	if err := dest.ctx.Err(); err != nil {
+		return err
+	}
+	if dest.reproducible {
+		// Always pax so the format doesn't vary with name lengths, ids, etc.
+		h.Format = tar.FormatPAX
+		h.AccessTime = time.Time{}
+		h.ChangeTime = time.Time{}
+	}
+	return dest.tar.WriteHeader(h)
+}
+
+// Sort everything in the layer by destination path, so the tar doesn't depend on
+// the order in the config
+func sortLayer(layer BuildImageArgsLayer) BuildImageArgsLayer {
+	layer.Remove = append([]string{}, layer.Remove...)
+	sort.Strings(layer.Remove)
+	layer.Files = sortFiles(layer.Files)
+	layer.Dirs = sortDirs(layer.Dirs)
+	layer.Devices = sortDevices(layer.Devices)
+	return layer
+}
+
+func sortFiles(files []BuildImageArgsFile) []BuildImageArgsFile {
+	files = append([]BuildImageArgsFile{}, files...)
+	name := func(f BuildImageArgsFile) string {
+		if f.Template != "" {
+			return Def(f.Name, f.Template.Filename())
+		}
+		return Def(f.Name, f.Source.Filename())
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return name(files[i]) < name(files[j])
+	})
+	return files
+}
+
+func sortDirs(dirs []BuildImageArgsDir) []BuildImageArgsDir {
+	dirs = append([]BuildImageArgsDir{}, dirs...)
+	for i, d := range dirs {
+		dirs[i].Dirs = sortDirs(d.Dirs)
+		dirs[i].Files = sortFiles(d.Files)
+		dirs[i].Devices = sortDevices(d.Devices)
+	}
+	name := func(d BuildImageArgsDir) string {
+		if d.Source != "" {
+			return Def(d.Name, d.Source.Filename())
+		}
+		return d.Name
+	}
+	sort.SliceStable(dirs, func(i, j int) bool {
+		return name(dirs[i]) < name(dirs[j])
+	})
+	return dirs
+}
+
+func sortDevices(devices []BuildImageArgsDevice) []BuildImageArgsDevice {
+	devices = append([]BuildImageArgsDevice{}, devices...)
+	sort.SliceStable(devices, func(i, j int) bool {
+		return devices[i].Name < devices[j].Name
+	})
+	return devices
+}
+
+// The file's fields are checked by argsValidator
+func writeDestFile(dest *destLayer, parentPath string, f BuildImageArgsFile) error {
+	if len(f.PlatformSources) != 0 {
+		platform := dest.templateData
+		found := false
+		for _, k := range []string{
+			platform.Os + "/" + platform.Arch + "/" + platform.Variant,
+			platform.Os + "/" + platform.Arch,
+			platform.Arch,
+		} {
+			if source, ok := f.PlatformSources[k]; ok {
+				f.Source = source
+				found = true
+				break
+			}
+		}
+		if !found && f.Source == "" {
+			return fmt.Errorf("file %s has no source for platform %s", f.Name, strings.TrimSuffix(platform.Os+"/"+platform.Arch+"/"+platform.Variant, "/"))
+		}
+	}
+	if isGlobSource(dest.sources, f.Source) {
+		matches, err := fs.Glob(dest.sources, sourcePath(f.Source))
+		if err != nil {
+			return fmt.Errorf("invalid glob source %s: %w", f.Source, err)
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("glob source %s didn't match any files", f.Source)
+		}
+		for _, m := range matches {
+			err := writeDestFile0(dest, parentPath, BuildImageArgsFile{
+				Source:        AbsPath("/" + m),
+				Process:       f.Process,
+				Mode:          f.Mode,
+				Uid:           f.Uid,
+				Gid:           f.Gid,
+				Uname:         f.Uname,
+				Gname:         f.Gname,
+				PreserveOwner: f.PreserveOwner,
+				IncludeLibs:   f.IncludeLibs,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return writeDestFile0(dest, parentPath, f)
+}
+
+// Write a regular file with in-memory contents, setting the header size
+func writeDestData(dest *destLayer, h *tar.Header, data []byte) error {
+	h.Size = int64(len(data))
+	if err := dest.writeHeader(h); err != nil {
+		return fmt.Errorf("error writing tar header for %s: %w", h.Name, err)
+	}
+	if _, err := dest.tar.Write(data); err != nil {
+		return fmt.Errorf("error writing %s to layer: %w", h.Name, err)
+	}
+	dest.onEvent(BuildEvent{
+		Kind: BuildEventFile,
+		Path: h.Name,
+		Size: h.Size,
+	})
+	if dest.sbomFiles != nil {
+		sha1Sum := sha1.Sum(data)
+		sha256Sum := sha256.Sum256(data)
+		*dest.sbomFiles = append(*dest.sbomFiles, sbomFile{
+			Path:   h.Name,
+			Size:   h.Size,
+			Sha1:   hex.EncodeToString(sha1Sum[:]),
+			Sha256: hex.EncodeToString(sha256Sum[:]),
+		})
+	}
+	return nil
+}
+
+// Write a file with a literal (non-glob) source
+func writeDestFile0(dest *destLayer, parentPath string, f BuildImageArgsFile) error {
+	var destName string
+	if f.Template != "" {
+		destName = Def(f.Name, f.Template.Filename())
+	} else {
+		destName = Def(f.Name, f.Source.Filename())
 	}
-	destName := Def(f.Name, f.Source.Filename())
 	var destPath string
 	if parentPath == "" {
 		destPath = destName
 	} else {
 		destPath = fmt.Sprintf("%s/%s", parentPath, destName)
 	}
-	if destFilesSeen[destPath] {
+	if _, seen := dest.seen[destPath]; seen {
 		return fmt.Errorf("the layer tar file has destination file or dir %s multiple times", destPath)
 	}
-	destFilesSeen[destPath] = true
-	mode, err := strconv.ParseInt(Def(f.Mode, "644"), 8, 32)
+	if f.HardLink != "" {
+		dest.seen[destPath] = tar.TypeLink
+		dest.links = append(dest.links, &tar.Header{
+			Typeflag: tar.TypeLink,
+			Name:     destPath,
+			Linkname: strings.TrimPrefix(f.HardLink, "/"),
+			ModTime:  dest.mtime,
+		})
+		return nil
+	}
+	dest.seen[destPath] = tar.TypeReg
+	modeSource := f.Source
+	if f.Template != "" {
+		modeSource = f.Template
+	}
+	mode, err := resolveMode(f.Mode, "644", dest.sources, modeSource)
+	if err != nil {
+		return fmt.Errorf("file %s mode %s is invalid: %w", destPath, f.Mode, err)
+	}
+	uid, gid, err := resolveOwner(f.PreserveOwner, f.Uid, f.Gid, dest.sources, modeSource)
 	if err != nil {
-		return fmt.Errorf("file %s mode %s is not valid octal: %w", destPath, f.Mode, err)
+		return fmt.Errorf("file %s: %w", destPath, err)
+	}
+	if f.Template != "" {
+		templateSource, err := fs.ReadFile(dest.sources, sourcePath(f.Template))
+		if err != nil {
+			return fmt.Errorf("error reading template %s: %w", f.Template, err)
+		}
+		t, err := template.New(f.Template.Filename()).Option("missingkey=error").Parse(string(templateSource))
+		if err != nil {
+			return fmt.Errorf("error parsing template %s: %w", f.Template, err)
+		}
+		var rendered bytes.Buffer
+		if err := t.Execute(&rendered, dest.templateData); err != nil {
+			return fmt.Errorf("error rendering template %s: %w", f.Template, err)
+		}
+		return writeDestData(dest, &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     destPath,
+			Mode:     mode,
+			Uid:      uid,
+			Gid:      gid,
+			Uname:    f.Uname,
+			Gname:    f.Gname,
+			ModTime:  dest.mtime,
+		}, rendered.Bytes())
+	}
+	sources := dest.sources
+	source := f.Source
+	if f.Source.IsUrl() {
+		downloaded, cleanup, err := downloadSource(dest.ctx, dest.cacheDir, f.Source, f.Sha256)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		sources = os.DirFS("/")
+		source = downloaded
+	}
+	if len(f.Process) != 0 {
+		processed, cleanup, err := processSource(dest.ctx, sources, source, f.Process)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		sources = os.DirFS("/")
+		source = processed
 	}
-	stat, err := os.Stat(f.Source.Raw())
+	stat, err := fs.Stat(sources, sourcePath(source))
 	if err != nil {
 		return fmt.Errorf("error looking up metadata for layer file %s: %w", f.Source, err)
 	}
-	if err := destTar.WriteHeader(&tar.Header{
+	if !stat.Mode().IsRegular() {
+		return fmt.Errorf("layer file source %s is not a regular file", f.Source)
+	}
+	if f.IncludeLibs {
+		libs, err := elfLibs(sources, source)
+		if err != nil {
+			return fmt.Errorf("file %s include_libs: %w", destPath, err)
+		}
+		for _, l := range libs {
+			dest.libs[l] = true
+		}
+	}
+	if err := dest.writeHeader(&tar.Header{
 		Typeflag: tar.TypeReg,
 		Name:     destPath,
 		Mode:     mode,
+		Uid:      uid,
+		Gid:      gid,
+		Uname:    f.Uname,
+		Gname:    f.Gname,
+		ModTime:  dest.mtime,
 		Size:     stat.Size(),
 	}); err != nil {
 		return fmt.Errorf("error writing tar header for %s: %w", f.Source, err)
 	}
-	fSource, err := os.Open(f.Source.Raw())
+	fSource, err := sources.Open(sourcePath(source))
 	if err != nil {
 		return fmt.Errorf("error opening source file %s for adding to layer: %w", f.Source, err)
 	}
-	_, err = io.Copy(destTar, fSource)
+	sha1Digester := sha1.New()
+	sha256Digester := sha256.New()
+	var tarDest io.Writer = dest.tar
+	if dest.sbomFiles != nil {
+		tarDest = io.MultiWriter(dest.tar, sha1Digester, sha256Digester)
+	}
+	_, err = io.Copy(tarDest, ctxReader{dest.ctx, fSource})
 	if err != nil {
 		return fmt.Errorf("error copying data from %s: %w", f.Source, err)
 	}
@@ -100,42 +555,223 @@ func writeDestFile(destFilesSeen map[string]bool, destTar *tar.Writer, parentPat
 	if err != nil {
 		return fmt.Errorf("error closing %s after reading: %w", f.Source, err)
 	}
+	dest.onEvent(BuildEvent{
+		Kind: BuildEventFile,
+		Path: destPath,
+		Size: stat.Size(),
+	})
+	if dest.sbomFiles != nil {
+		*dest.sbomFiles = append(*dest.sbomFiles, sbomFile{
+			Path:   destPath,
+			Size:   stat.Size(),
+			Sha1:   hex.EncodeToString(sha1Digester.Sum(nil)),
+			Sha256: hex.EncodeToString(sha256Digester.Sum(nil)),
+		})
+	}
+	return nil
+}
+
+// The device's fields are checked by argsValidator
+func writeDestDevice(dest *destLayer, parentPath string, n BuildImageArgsDevice) error {
+	var destPath string
+	if parentPath == "" {
+		destPath = n.Name
+	} else {
+		destPath = fmt.Sprintf("%s/%s", parentPath, n.Name)
+	}
+	var typeflag byte
+	switch n.Type {
+	case "char":
+		typeflag = tar.TypeChar
+	case "block":
+		typeflag = tar.TypeBlock
+	case "fifo":
+		typeflag = tar.TypeFifo
+	default:
+		return fmt.Errorf("device %s has unknown type %s, must be one of char, block, or fifo", destPath, n.Type)
+	}
+	if _, seen := dest.seen[destPath]; seen {
+		return fmt.Errorf("the layer tar file has destination file or dir %s multiple times", destPath)
+	}
+	dest.seen[destPath] = typeflag
+	mode, err := strconv.ParseInt(Def(n.Mode, "666"), 8, 32)
+	if err != nil {
+		return fmt.Errorf("device %s mode %s is not valid octal: %w", destPath, n.Mode, err)
+	}
+	if err := dest.writeHeader(&tar.Header{
+		Typeflag: typeflag,
+		Name:     destPath,
+		Mode:     mode,
+		Uid:      n.Uid,
+		Gid:      n.Gid,
+		Uname:    n.Uname,
+		Gname:    n.Gname,
+		ModTime:  dest.mtime,
+		Devmajor: n.Major,
+		Devminor: n.Minor,
+	}); err != nil {
+		return fmt.Errorf("error writing tar header for %s: %w", destPath, err)
+	}
 	return nil
 }
 
-func buildDestDir(destFilesSeen map[string]bool, destTar *tar.Writer, parentPath string, d BuildImageArgsDir) error {
-	if strings.Contains(d.Name, "/") {
-		return fmt.Errorf("Dir %s name contains slashes; subdirs must be nested as objects", d.Name)
+// Marks whiteouts in destLayer.seen, so they aren't treated as regular files (ex:
+// as hardlink targets)
+const seenWhiteout byte = 0xff
+
+// Write an entry hiding a path in the FROM layers
+func writeDestWhiteout(dest *destLayer, p string) error {
+	p = path.Clean(strings.TrimPrefix(p, "/"))
+	if p == "." || p == "/" {
+		return fmt.Errorf("can't remove the image root")
+	}
+	parent, name := path.Split(p)
+	destPath := parent + ".wh." + name
+	if _, seen := dest.seen[destPath]; seen {
+		return fmt.Errorf("path %s is removed multiple times", p)
+	}
+	dest.seen[destPath] = seenWhiteout
+	if err := dest.writeHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     destPath,
+		Mode:     0o644,
+		ModTime:  dest.mtime,
+	}); err != nil {
+		return fmt.Errorf("error writing tar header for whiteout %s: %w", destPath, err)
+	}
+	return nil
+}
+
+// `excludes` are inherited from the parent dir when copying from its source. The
+// dir's fields are checked by argsValidator.
+func buildDestDir(dest *destLayer, parentPath string, d BuildImageArgsDir, excludes *sourceExcludes) error {
+	restoreSources := func() {}
+	if d.Git != nil {
+		checkout, cleanup, err := checkoutGitSource(dest.ctx, *d.Git)
+		if err != nil {
+			return fmt.Errorf("error checking out git source for dir %s: %w", d.Name, err)
+		}
+		defer cleanup()
+		// The checkout is on the host, not in the sources fs
+		parentSources := dest.sources
+		dest.sources = os.DirFS("/")
+		restoreSources = func() {
+			dest.sources = parentSources
+		}
+		d.Source = checkout
+		d.Exclude = append([]string{".git"}, d.Exclude...)
+	}
+	destName := d.Name
+	if d.Source != "" {
+		destName = Def(destName, d.Source.Filename())
 	}
 	var destPath string
 	if parentPath == "" {
-		destPath = d.Name
+		destPath = destName
 	} else {
-		destPath = fmt.Sprintf("%s/%s", parentPath, d.Name)
+		destPath = fmt.Sprintf("%s/%s", parentPath, destName)
 	}
-	if destFilesSeen[destPath] {
+	if _, seen := dest.seen[destPath]; seen {
 		return fmt.Errorf("the layer tar file has destination file or dir %s multiple times", destPath)
 	}
-	destFilesSeen[destPath] = true
-	mode, err := strconv.ParseInt(Def(d.Mode, "644"), 8, 32)
+	dest.seen[destPath] = tar.TypeDir
+	mode, err := resolveMode(d.Mode, "755", dest.sources, d.Source)
+	if err != nil {
+		return fmt.Errorf("dir %s mode %s is invalid: %w", destPath, d.Mode, err)
+	}
+	uid, gid, err := resolveOwner(d.PreserveOwner, d.Uid, d.Gid, dest.sources, d.Source)
 	if err != nil {
-		return fmt.Errorf("file %s mode %s is not valid octal: %w", destPath, d.Mode, err)
+		return fmt.Errorf("dir %s: %w", destPath, err)
 	}
-	if err := destTar.WriteHeader(&tar.Header{
+	if err := dest.writeHeader(&tar.Header{
 		Typeflag: tar.TypeDir,
 		Name:     destPath,
 		Mode:     mode,
+		Uid:      uid,
+		Gid:      gid,
+		Uname:    d.Uname,
+		Gname:    d.Gname,
+		ModTime:  dest.mtime,
 	}); err != nil {
 		return fmt.Errorf("error writing tar header for %s: %w", destPath, err)
 	}
+	if d.Source != "" {
+		if len(d.Exclude) != 0 {
+			excludes, err = newSourceExcludes(d.Source, d.Exclude)
+			if err != nil {
+				return fmt.Errorf("dir %s: %w", destPath, err)
+			}
+		}
+		sourceStat, err := fs.Stat(dest.sources, sourcePath(d.Source))
+		if err != nil {
+			return fmt.Errorf("error looking up metadata for source dir %s: %w", d.Source, err)
+		}
+		leaveSourceDir, err := enterSourceDir(dest.sourceDirs, sourceStat, d.Source)
+		if err != nil {
+			return err
+		}
+		defer leaveSourceDir()
+		entries, err := fs.ReadDir(dest.sources, sourcePath(d.Source))
+		if err != nil {
+			return fmt.Errorf("error listing source dir %s: %w", d.Source, err)
+		}
+		// Preserving modes applies to everything copied from the source
+		childMode := ""
+		if d.Mode == modePreserve {
+			childMode = modePreserve
+		}
+		for _, e := range entries {
+			source := d.Source.Join(e.Name())
+			if excludes.excluded(sourcePath(source)) {
+				continue
+			}
+			stat, err := fs.Stat(dest.sources, sourcePath(source))
+			if err != nil {
+				return fmt.Errorf("error looking up metadata for source dir entry %s: %w", source, err)
+			}
+			if stat.IsDir() {
+				err = buildDestDir(dest, destPath, BuildImageArgsDir{
+					Source:        source,
+					Mode:          childMode,
+					Uid:           d.Uid,
+					Gid:           d.Gid,
+					Uname:         d.Uname,
+					Gname:         d.Gname,
+					PreserveOwner: d.PreserveOwner,
+				}, excludes)
+			} else if stat.Mode().IsRegular() {
+				err = writeDestFile0(dest, destPath, BuildImageArgsFile{
+					Source:        source,
+					Mode:          childMode,
+					Uid:           d.Uid,
+					Gid:           d.Gid,
+					Uname:         d.Uname,
+					Gname:         d.Gname,
+					PreserveOwner: d.PreserveOwner,
+				})
+			} else {
+				err = fmt.Errorf("source dir entry %s is not a regular file or dir", source)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	restoreSources()
 	for _, f := range d.Dirs {
-		err := buildDestDir(destFilesSeen, destTar, destPath, f)
+		err := buildDestDir(dest, destPath, f, nil)
 		if err != nil {
 			return err
 		}
 	}
 	for _, f := range d.Files {
-		err := writeDestFile(destFilesSeen, destTar, destPath, f)
+		err := writeDestFile(dest, destPath, f)
+		if err != nil {
+			return err
+		}
+	}
+	for _, n := range d.Devices {
+		err := writeDestDevice(dest, destPath, n)
 		if err != nil {
 			return err
 		}
@@ -143,29 +779,129 @@ func buildDestDir(destFilesSeen map[string]bool, destTar *tar.Writer, parentPath
 	return nil
 }
 
+// Determine the descriptor info of a tar, tar.gz, or tar.zst layer file
+func digestLayerFile(f io.ReadSeeker) (mediaType string, layerDigest digest.Digest, diffId digest.Digest, size int64, err error) {
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", "", "", 0, fmt.Errorf("error reading layer file header: %w", err)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return "", "", "", 0, fmt.Errorf("error rewinding layer file: %w", err)
+	}
+	digester := sha256.New()
+	if bytes.Equal(magic, zstdMagic) {
+		uncompressedDigester := sha256.New()
+		zstdReader, err := zstd.NewReader(io.TeeReader(f, digester))
+		if err != nil {
+			return "", "", "", 0, fmt.Errorf("error opening layer file as zstd: %w", err)
+		}
+		defer zstdReader.Close()
+		if _, err := io.Copy(uncompressedDigester, zstdReader); err != nil {
+			return "", "", "", 0, fmt.Errorf("error decompressing layer file: %w", err)
+		}
+		// Zstd reads to EOF (including skippable frames, ex: zstd:chunked metadata), so
+		// the position is the size of the file
+		size, err = f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return "", "", "", 0, fmt.Errorf("error determining layer file size: %w", err)
+		}
+		return imagespec.MediaTypeImageLayerZstd,
+			digest.NewDigest(digest.SHA256, digester),
+			digest.NewDigest(digest.SHA256, uncompressedDigester),
+			size,
+			nil
+	}
+	if magic[0] == 0x1f && magic[1] == 0x8b {
+		uncompressedDigester := sha256.New()
+		gzReader, err := gzip.NewReader(io.TeeReader(f, digester))
+		if err != nil {
+			return "", "", "", 0, fmt.Errorf("error opening layer file as gzip: %w", err)
+		}
+		if _, err := io.Copy(uncompressedDigester, gzReader); err != nil {
+			return "", "", "", 0, fmt.Errorf("error decompressing layer file: %w", err)
+		}
+		// Gzip reads to EOF, so the position is the size of the file
+		size, err = f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return "", "", "", 0, fmt.Errorf("error determining layer file size: %w", err)
+		}
+		return imagespec.MediaTypeImageLayerGzip,
+			digest.NewDigest(digest.SHA256, digester),
+			digest.NewDigest(digest.SHA256, uncompressedDigester),
+			size,
+			nil
+	}
+	size, err = io.Copy(digester, f)
+	if err != nil {
+		return "", "", "", 0, fmt.Errorf("error reading layer file: %w", err)
+	}
+	layerDigest = digest.NewDigest(digest.SHA256, digester)
+	return imagespec.MediaTypeImageLayer, layerDigest, layerDigest, size, nil
+}
+
 func BuildImage(args BuildImageArgs) (hash string, err error) {
+	return BuildImageContext(context.Background(), args)
+}
+
+// Like BuildImage, but stops with the context's error if it's cancelled. The
+// arguments are checked with ValidateBuildImageArgs before building.
+func BuildImageContext(ctx context.Context, args BuildImageArgs) (hash string, err error) {
+	if errs := ValidateBuildImageArgs(args); len(errs) != 0 {
+		return "", errors.Join(errs...)
+	}
+	if len(args.Platforms) != 0 {
+		return buildImageIndex(ctx, args)
+	}
+	return buildImage(ctx, args)
+}
+
+// Build the image for a single platform, after validating
+func buildImage(ctx context.Context, args BuildImageArgs) (hash string, err error) {
 	hashData := map[string]any{}
+	onEvent := args.OnEvent
+	if onEvent == nil {
+		onEvent = func(BuildEvent) {}
+	}
+	sources := args.SourceFS
+	if sources == nil {
+		sources = os.DirFS("/")
+	}
+	logger := args.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
 
-	if err := os.MkdirAll(args.DestDirPath.Raw(), 0o755); err != nil {
-		return "", fmt.Errorf("error creating staging dir for image at %s: %w", args.DestDirPath, err)
+	if args.Dest == nil {
+		if err := os.MkdirAll(args.DestDirPath.Raw(), 0o755); err != nil {
+			return "", fmt.Errorf("error creating staging dir for image at %s: %w", args.DestDirPath, err)
+		}
 	}
 
 	// Util functions
 	writeMemory := func(name string, contents []byte) error {
+		// Keyed by the path within the layout so the hash doesn't depend on where it's built
+		hashData[name] = contents
+		if args.Dest != nil {
+			// No layout
+			return nil
+		}
 		p := args.DestDirPath.Join(name).Raw()
-		hashData[p] = contents
 		if err := ioutil.WriteFile(p, contents, 0o600); err != nil {
 			return fmt.Errorf("error writing tar file %s: %w", name, err)
 		}
 		return nil
 	}
-	blobPath := func(digest digest.Digest) string {
-		return fmt.Sprintf("blobs/%s/%s", digest.Algorithm().String(), digest.Hex())
-	}
 	writeBlob := func(digest digest.Digest, contents []byte) error {
-		p := blobPath(digest)
-		hashData[p] = contents
-		return writeMemory(p, contents)
+		if args.Dest != nil {
+			// Only the config is written from memory when streaming, the manifest is
+			// handled separately
+			hashData[blobPath(digest)] = contents
+			if err := args.Dest.PutBlob(ctx, digest, int64(len(contents)), bytes.NewReader(contents), true); err != nil {
+				return fmt.Errorf("error writing blob %s: %w", digest, err)
+			}
+			return nil
+		}
+		return writeMemory(blobPath(digest), contents)
 	}
 	buildJson := func(contents any) (digest.Digest, []byte) {
 		contents1 := canonicalJsonMarshal(contents)
@@ -179,7 +915,20 @@ func BuildImage(args BuildImageArgs) (hash string, err error) {
 	writeJson := func(name string, contents any) error {
 		return writeMemory(name, canonicalJsonMarshal(contents))
 	}
-	writeBlobReader := func(digest digest.Digest, size int64, reader io.Reader) error {
+	writeBlobReader0 := func(digest digest.Digest, size int64, reader io.Reader) error {
+		if args.Dest != nil {
+			blobHash := sha256.New()
+			teeReader := io.TeeReader(reader, blobHash)
+			if err := args.Dest.PutBlob(ctx, digest, size, ctxReader{ctx, teeReader}, false); err != nil {
+				return fmt.Errorf("error writing blob %s: %w", digest, err)
+			}
+			// Finish hashing if the dest skipped the blob
+			if _, err := io.Copy(io.Discard, teeReader); err != nil {
+				return fmt.Errorf("error reading blob %s: %w", digest, err)
+			}
+			hashData[blobPath(digest)] = hex.EncodeToString(blobHash.Sum([]byte{}))
+			return nil
+		}
 		p := args.DestDirPath.Join(blobPath(digest))
 		if err := os.MkdirAll(p.Parent().Raw(), 0o755); err != nil {
 			return fmt.Errorf("unable to create parent directories for image file %s: %w", p, err)
@@ -190,16 +939,29 @@ func BuildImage(args BuildImageArgs) (hash string, err error) {
 		}
 		defer func() {
 			if err := f.Close(); err != nil {
-				log.Printf("Error closing %s: %s", p, err)
+				logger.Printf("Error closing %s: %s", p, err)
 			}
 		}()
 		blobHash := sha256.New()
 		multiWrite := io.MultiWriter(blobHash, f)
-		_, err = io.Copy(multiWrite, reader)
+		_, err = io.Copy(multiWrite, ctxReader{ctx, reader})
 		if err != nil {
 			return fmt.Errorf("error writing layer to tar: %w", err)
 		}
-		hashData[p.Raw()] = hex.EncodeToString(blobHash.Sum([]byte{}))
+		hashData[blobPath(digest)] = hex.EncodeToString(blobHash.Sum([]byte{}))
+		return nil
+	}
+
+	// Only used for layers
+	writeBlobReader := func(digest digest.Digest, size int64, reader io.Reader) error {
+		if err := writeBlobReader0(digest, size, reader); err != nil {
+			return err
+		}
+		onEvent(BuildEvent{
+			Kind:   BuildEventLayer,
+			Digest: digest,
+			Size:   size,
+		})
 		return nil
 	}
 
@@ -210,166 +972,748 @@ func BuildImage(args BuildImageArgs) (hash string, err error) {
 		return "", err
 	}
 
-	layerDiffIds := []digest.Digest{}
+	// With squash, layers are collected here (instead of being written) and merged
+	// into a single layer at the end
+	squashing := args.Squash
+	squashSources := []squashSource{}
+	// Layers copied as is (from FROM, copy_from, and prebuilt tars), to check for
+	// paths in them
+	lowerSources := []squashSource{}
+
+	// Like copyImageLayers below, for images in the `docker save` format
+	copyDockerArchiveLayers := func(p AbsPath, tfs fs.FS) (layerMetas []imagespec.Descriptor, layerDiffIds []digest.Digest, config dockerImage, err error) {
+		manifests, err := readTarFsJson[[]dockerArchiveManifest](tfs, "manifest.json")
+		if err != nil {
+			return nil, nil, config, err
+		}
+		if len(manifests) != 1 {
+			return nil, nil, config, fmt.Errorf("docker archive must contain exactly one image, but it has %d", len(manifests))
+		}
+		manifest := manifests[0]
+		// Docker configs are a superset of oci configs
+		config, err = readTarFsJson[dockerImage](tfs, manifest.Config)
+		if err != nil {
+			return nil, nil, config, fmt.Errorf("unable to find config %s referenced in archive manifest: %w", manifest.Config, err)
+		}
+		for _, layerPath := range manifest.Layers {
+			source, err := tfs.Open(layerPath)
+			if err != nil {
+				return nil, nil, config, fmt.Errorf("error opening layer %s referenced in archive manifest: %w", layerPath, err)
+			}
+			seekSource, ok := source.(io.ReadSeeker)
+			if !ok {
+				panic("tarfs file not seekable")
+			}
+			mediaType, layerDigest, _, size, err := digestLayerFile(seekSource)
+			if err != nil {
+				return nil, nil, config, fmt.Errorf("error reading layer %s: %w", layerPath, err)
+			}
+			if _, err := seekSource.Seek(0, 0); err != nil {
+				return nil, nil, config, fmt.Errorf("error rewinding layer %s: %w", layerPath, err)
+			}
+			lowerSources = append(lowerSources, squashArchiveSource(p, layerPath))
+			if squashing {
+				squashSources = append(squashSources, squashArchiveSource(p, layerPath))
+			} else if err := writeBlobReader(layerDigest, size, seekSource); err != nil {
+				return nil, nil, config, fmt.Errorf("error copying layer %s to new image: %w", layerPath, err)
+			}
+			layerMetas = append(layerMetas, imagespec.Descriptor{
+				MediaType: mediaType,
+				Digest:    layerDigest,
+				Size:      size,
+			})
+		}
+		return layerMetas, config.RootFS.DiffIDs, config, nil
+	}
+
+	// Copy the layers of an oci-archive image into the new image, returning their
+	// info and the image config. Also accepts docker-archive images.
+	copyImageLayers := func(p AbsPath) (layerMetas []imagespec.Descriptor, layerDiffIds []digest.Digest, config dockerImage, err error) {
+		tf, err := os.Open(p.Raw())
+		if err != nil {
+			return nil, nil, config, fmt.Errorf("unable to open image: %w", err)
+		}
+		defer tf.Close()
+
+		tfs, err := tarfs.New(tf)
+		if err != nil {
+			return nil, nil, config, fmt.Errorf("unable to open image as tar: %w", err)
+		}
+
+		if _, err := fs.Stat(tfs, "index.json"); errors.Is(err, fs.ErrNotExist) {
+			return copyDockerArchiveLayers(p, tfs)
+		}
+
+		index, err := readTarFsJson[imagespec.Index](tfs, "index.json")
+		if err != nil {
+			return nil, nil, config, err
+		}
+		m, err := selectManifest(tfs, index, args.Architecture, args.Os, args.Variant, args.OsVersion)
+		if err != nil {
+			return nil, nil, config, err
+		}
+
+		manifest, err := readTarFsJson[imagespec.Manifest](tfs, blobPath(m.Digest))
+		if err != nil {
+			return nil, nil, config, fmt.Errorf("unable to find manifest %s referenced in tar index: %w", m.Digest, err)
+		}
+		for _, layer := range manifest.Layers {
+			lowerSources = append(lowerSources, squashArchiveSource(p, blobPath(layer.Digest)))
+			if squashing {
+				squashSources = append(squashSources, squashArchiveSource(p, blobPath(layer.Digest)))
+				continue
+			}
+			source, err := tfs.Open(blobPath(layer.Digest))
+			if err != nil {
+				return nil, nil, config, fmt.Errorf("error opening layer %s referenced in image manifest: %w", layer.Digest, err)
+			}
+			err = writeBlobReader(layer.Digest, layer.Size, source)
+			if err != nil {
+				return nil, nil, config, fmt.Errorf("error copying layer %s to new image: %w", layer.Digest, err)
+			}
+		}
+
+		config, err = readTarFsJson[dockerImage](tfs, blobPath(manifest.Config.Digest))
+		if err != nil {
+			return nil, nil, config, fmt.Errorf("unable to find config %s referenced in image manifest: %w", manifest.Config.Digest, err)
+		}
+		return manifest.Layers, config.RootFS.DiffIDs, config, nil
+	}
+
+	// Write `from` layers, pull `from` info
+	fromLayerDiffIds := []digest.Digest{}
+	fromLayerMetas := []imagespec.Descriptor{}
+	var fromConfig dockerImage
+	if args.FromPath != "" {
+		var err error
+		fromLayerMetas, fromLayerDiffIds, fromConfig, err = copyImageLayers(args.FromPath)
+		if err != nil {
+			return "", fmt.Errorf("error reading FROM image %s: %w", args.FromPath, err)
+		}
+	}
+	fromEnv := map[string]string{}
+	for _, e := range fromConfig.Config.Env {
+		k, v, _ := strings.Cut(e, "=")
+		fromEnv[k] = v
+	}
+	envMap := map[string]string{}
+	if !args.ClearEnv {
+		for k, v := range fromEnv {
+			envMap[k] = v
+		}
+	}
+	for _, k := range args.RemoveEnv {
+		delete(envMap, k)
+	}
+	for k, v := range args.AddEnv {
+		// References like `${PATH}` are to the FROM image env, `$$` is a literal `$`
+		envMap[k] = os.Expand(v, func(name string) string {
+			if name == "$" {
+				return "$"
+			}
+			return fromEnv[name]
+		})
+	}
+	env := []string{}
+	for k, v := range envMap {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(env)
+	labels := map[string]string{}
+	if !args.ClearLabels {
+		for k, v := range fromConfig.Config.Labels {
+			labels[k] = v
+		}
+	}
+	for k, v := range args.Labels {
+		labels[k] = v
+	}
+	architecture := Def(args.Architecture, fromConfig.Architecture)
+	os_ := Def(args.Os, fromConfig.OS)
+	variant := Def(args.Variant, fromConfig.Variant)
+	osVersion := Def(args.OsVersion, fromConfig.OSVersion)
+	osFeatures := args.OsFeatures
+	if osFeatures == nil {
+		osFeatures = fromConfig.OSFeatures
+	}
+
+	// Base layers first, then copied and additional layers, then own layer on top
+	layerDiffIds := append([]digest.Digest{}, fromLayerDiffIds...)
 	type LayerMeta struct {
 		type_  string
 		digest digest.Digest
 		size   int64
 	}
-	layerMetas := []imagespec.Descriptor{}
+	layerMetas := append([]imagespec.Descriptor{}, fromLayerMetas...)
 
-	// Write own layer
-	{
+	// Write prebuilt layers
+	writePrebuiltLayer := func(l AbsPath) error {
+		f, err := os.Open(l.Raw())
+		if err != nil {
+			return fmt.Errorf("error opening layer file: %w", err)
+		}
+		defer f.Close()
+		mediaType, layerDigest, diffId, size, err := digestLayerFile(f)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, 0); err != nil {
+			return fmt.Errorf("error rewinding layer file: %w", err)
+		}
+		lowerSources = append(lowerSources, squashFileSource(l))
+		if squashing {
+			squashSources = append(squashSources, squashFileSource(l))
+		} else if err := writeBlobReader(layerDigest, size, f); err != nil {
+			return err
+		}
+		layerMetas = append(layerMetas, imagespec.Descriptor{
+			MediaType: mediaType,
+			Digest:    layerDigest,
+			Size:      size,
+		})
+		layerDiffIds = append(layerDiffIds, diffId)
+		return nil
+	}
+
+	// A rootfs goes where the FROM layers would be
+	if args.FromRootfs != "" {
+		if err := writePrebuiltLayer(args.FromRootfs); err != nil {
+			return "", fmt.Errorf("error adding FROM rootfs %s: %w", args.FromRootfs, err)
+		}
+	}
+
+	// Write layers of other images
+	for _, p := range args.CopyFrom {
+		copyLayerMetas, copyLayerDiffIds, _, err := copyImageLayers(p)
+		if err != nil {
+			return "", fmt.Errorf("error reading copy-from image %s: %w", p, err)
+		}
+		layerMetas = append(layerMetas, copyLayerMetas...)
+		layerDiffIds = append(layerDiffIds, copyLayerDiffIds...)
+	}
+
+	// Write layers built from files
+	var sbomFiles *[]sbomFile
+	if args.SbomPath != "" {
+		sbomFiles = &[]sbomFile{}
+	}
+	// Write a layer with the tar entries written by `fill`. With squash, the
+	// uncompressed tar is kept in a temp file to be merged at the end instead.
+	squashTemps := []string{}
+	defer func() {
+		for _, p := range squashTemps {
+			if err := os.Remove(p); err != nil {
+				logger.Printf("Warning: failed to remove squash temp file %s: %s", p, err)
+			}
+		}
+	}()
+	writeTarLayer := func(fill func(destTar *tar.Writer) error) error {
+		if squashing {
+			tmpTar, err := os.CreateTemp("", ".dinker-squash-*")
+			if err != nil {
+				return fmt.Errorf("error creating temp file for layer to squash: %w", err)
+			}
+			squashTemps = append(squashTemps, tmpTar.Name())
+			defer tmpTar.Close()
+			destTar := tar.NewWriter(tmpTar)
+			if err := fill(destTar); err != nil {
+				return err
+			}
+			if err := destTar.Close(); err != nil {
+				return fmt.Errorf("error closing layer tar: %w", err)
+			}
+			squashSources = append(squashSources, squashFileSource(AbsPath(tmpTar.Name())))
+			return nil
+		}
 		// Build image in temp file
-		tmpLayer, err := os.CreateTemp("", ".dinker-layer-*") // todo delete
+		tmpLayer, err := os.CreateTemp("", ".dinker-layer-*")
 		if err != nil {
-			return "", fmt.Errorf("error creating temp file for new layer: %w", err)
+			return fmt.Errorf("error creating temp file for new layer: %w", err)
 		}
 		defer func() {
+			if err := tmpLayer.Close(); err != nil {
+				logger.Printf("Warning: failed to close layer temp file %s: %s", tmpLayer.Name(), err)
+			}
 			err := os.Remove(tmpLayer.Name())
 			if err != nil {
-				log.Printf("Warning: failed to remove layer temp file %s: %s", tmpLayer.Name(), err)
+				logger.Printf("Warning: failed to remove layer temp file %s: %s", tmpLayer.Name(), err)
 			}
 		}()
 		uncompressedDigester := sha256.New()
 		compressedDigester := sha256.New()
-		gzWriter := gzip.NewWriter(io.MultiWriter(
+		compressedWriter := io.MultiWriter(
 			compressedDigester,
 			tmpLayer,
-		))
-		destTar := tar.NewWriter(io.MultiWriter(
-			uncompressedDigester,
-			gzWriter,
-		))
-		destFilesSeen := map[string]bool{}
-		for _, f := range args.Files {
-			err := writeDestFile(destFilesSeen, destTar, "", f)
+		)
+		var compressWriter io.WriteCloser
+		var stargzWriter *estargzWriter
+		var chunkedMetadata map[string]string
+		var mediaType string
+		compression := Def(args.Compression, "gzip")
+		switch compression {
+		case "gzip":
+			gzWriter := pgzip.NewWriter(compressedWriter)
+			if args.CompressionThreads != 0 {
+				if err := gzWriter.SetConcurrency(1<<20, args.CompressionThreads); err != nil {
+					_ = gzWriter.Close()
+					return fmt.Errorf("invalid compression thread count %d: %w", args.CompressionThreads, err)
+				}
+			}
+			compressWriter = gzWriter
+			mediaType = imagespec.MediaTypeImageLayerGzip
+		case "estargz":
+			stargzWriter = newEstargzWriter(compressedWriter)
+			compressWriter = stargzWriter
+			mediaType = imagespec.MediaTypeImageLayerGzip
+		case "zstd:chunked":
+			// Filled in with the annotations locating the chunk metadata when closed
+			chunkedMetadata = map[string]string{}
+			compressWriter, err = compressor.ZstdCompressor(compressedWriter, chunkedMetadata, nil)
 			if err != nil {
-				return "", err
+				return fmt.Errorf("error starting zstd:chunked compressor: %w", err)
 			}
+			mediaType = imagespec.MediaTypeImageLayerZstd
+		case "none":
+			compressWriter = nopWriteCloser{compressedWriter}
+			mediaType = imagespec.MediaTypeImageLayer
+		default:
+			return fmt.Errorf("unknown layer compression %s, must be gzip, estargz, zstd:chunked, or none", args.Compression)
+		}
+		// Stop the compressor's workers if building fails, otherwise it's closed
+		// explicitly to check the error
+		compressClosed := false
+		closeCompressor := func() error {
+			compressClosed = true
+			return compressWriter.Close()
 		}
-		for _, d := range args.Dirs {
-			err := buildDestDir(destFilesSeen, destTar, "", d)
+		defer func() {
+			if !compressClosed {
+				_ = compressWriter.Close()
+			}
+		}()
+		// With a cache, write the uncompressed tar to a temp file first so compression
+		// can be skipped if the layer is already cached
+		var tarWriter io.Writer = compressWriter
+		var tmpTar *os.File
+		if args.CacheDir != "" {
+			tmpTar, err = os.CreateTemp("", ".dinker-layer-tar-*")
 			if err != nil {
-				return "", err
+				return fmt.Errorf("error creating temp file for new layer tar: %w", err)
 			}
+			defer func() {
+				if err := tmpTar.Close(); err != nil {
+					logger.Printf("Warning: failed to close layer tar temp file %s: %s", tmpTar.Name(), err)
+				}
+				if err := os.Remove(tmpTar.Name()); err != nil {
+					logger.Printf("Warning: failed to remove layer tar temp file %s: %s", tmpTar.Name(), err)
+				}
+			}()
+			tarWriter = tmpTar
+		}
+		destTar := tar.NewWriter(io.MultiWriter(
+			uncompressedDigester,
+			tarWriter,
+		))
+		if err := fill(destTar); err != nil {
+			return err
 		}
 		if err := destTar.Close(); err != nil {
-			return "", fmt.Errorf("error closing layer tar: %w", err)
+			return fmt.Errorf("error closing layer tar: %w", err)
 		}
-		if err := gzWriter.Close(); err != nil {
-			return "", fmt.Errorf("error closing layer tar gz: %w", err)
+		tarDigest := digest.NewDigest(digest.SHA256, uncompressedDigester)
+		if tmpTar != nil {
+			cached, cachedBlob, err := readLayerCache(args.CacheDir, compression, tarDigest)
+			if err != nil {
+				return err
+			}
+			if cached != nil {
+				defer cachedBlob.Close()
+				// Only to stop the compressor, nothing was written to it
+				_ = closeCompressor()
+				layerMetas = append(layerMetas, cached.Descriptor)
+				layerDiffIds = append(layerDiffIds, cached.DiffId)
+				return writeBlobReader(cached.Descriptor.Digest, cached.Descriptor.Size, cachedBlob)
+			}
+			if _, err := tmpTar.Seek(0, 0); err != nil {
+				panic(err)
+			}
+			if _, err := io.Copy(compressWriter, ctxReader{ctx, tmpTar}); err != nil {
+				return fmt.Errorf("error compressing layer tar: %w", err)
+			}
+		}
+		if err := closeCompressor(); err != nil {
+			return fmt.Errorf("error closing layer tar compressor: %w", err)
 		}
 		stat, err := tmpLayer.Stat()
 		if err != nil {
-			return "", fmt.Errorf("error reading temp layer file metadata: %w", err)
+			return fmt.Errorf("error reading temp layer file metadata: %w", err)
 		}
 
 		layerDigest := digest.NewDigest(digest.SHA256, compressedDigester)
-		layerMetas = append(layerMetas, imagespec.Descriptor{
-			MediaType: imagespec.MediaTypeImageLayerGzip,
-			Digest:    layerDigest,
-			Size:      stat.Size(),
-		})
-		layerDiffIds = append(layerDiffIds, digest.NewDigest(digest.SHA256, uncompressedDigester))
+		diffId := tarDigest
+		var annotations map[string]string
+		if stargzWriter != nil {
+			// Estargz adds its own entries so the uncompressed data differs from the written tar
+			diffId = stargzWriter.diffId
+			annotations = map[string]string{
+				estargz.TOCJSONDigestAnnotation: stargzWriter.tocDigest.String(),
+			}
+		}
+		if len(chunkedMetadata) != 0 {
+			annotations = chunkedMetadata
+		}
+		layerMeta := imagespec.Descriptor{
+			MediaType:   mediaType,
+			Digest:      layerDigest,
+			Size:        stat.Size(),
+			Annotations: annotations,
+		}
+		layerMetas = append(layerMetas, layerMeta)
+		layerDiffIds = append(layerDiffIds, diffId)
 
+		if tmpTar != nil {
+			_, err = tmpLayer.Seek(0, 0)
+			if err != nil {
+				panic(err)
+			}
+			if err := writeLayerCache(args.CacheDir, compression, tarDigest, cachedLayer{
+				Descriptor: layerMeta,
+				DiffId:     diffId,
+			}, tmpLayer); err != nil {
+				return err
+			}
+		}
 		_, err = tmpLayer.Seek(0, 0)
 		if err != nil {
 			panic(err)
 		}
-		err = writeBlobReader(layerDigest, stat.Size(), tmpLayer)
-		if err != nil {
-			return "", err
-		}
+		return writeBlobReader(layerDigest, stat.Size(), tmpLayer)
 	}
 
-	// Write `from` layers, pull `from` info
-	var fromConfig imagespec.Image
-	if args.FromPath != "" {
-		if err := func() error {
-			tf, err := os.Open(args.FromPath.Raw())
+	// The types of the paths in the lower layers, read when first needed. Layers
+	// added since the last call are read on the next.
+	lowerPaths := map[string]byte{}
+	lowerRead := 0
+	readLowerPaths := func() (map[string]byte, error) {
+		for ; lowerRead < len(lowerSources); lowerRead++ {
+			err := func() error {
+				r, err := lowerSources[lowerRead]()
+				if err != nil {
+					return err
+				}
+				defer r.Close()
+				tr := tar.NewReader(r)
+				for {
+					h, err := tr.Next()
+					if errors.Is(err, io.EOF) {
+						return nil
+					}
+					if err != nil {
+						return fmt.Errorf("error reading layer tar: %w", err)
+					}
+					p := squashPath(h.Name)
+					dir, name := path.Split(p)
+					if removed, found := strings.CutPrefix(name, ".wh."); found {
+						if removed != ".wh..opq" {
+							delete(lowerPaths, path.Join(dir, removed))
+						}
+						continue
+					}
+					lowerPaths[p] = h.Typeflag
+				}
+			}()
 			if err != nil {
-				return fmt.Errorf("unable to open `from` image: %w", err)
+				return nil, fmt.Errorf("error listing paths in lower layer %d: %w", lowerRead, err)
 			}
-			defer tf.Close()
+		}
+		return lowerPaths, nil
+	}
 
-			tfs, err := tarfs.New(tf)
-			if err != nil {
-				return fmt.Errorf("unable to open `from` image as tar: %w", err)
+	writeBuiltLayer := func(layer BuildImageArgsLayer, user *createUser) error {
+		onEvent(BuildEvent{Kind: BuildEventLayerStart})
+		fill := func(destTar *tar.Writer) error {
+			dest := &destLayer{
+				tar:          destTar,
+				seen:         map[string]byte{},
+				mtime:        args.Created,
+				sbomFiles:    sbomFiles,
+				reproducible: args.Reproducible,
+				ctx:          ctx,
+				onEvent:      onEvent,
+				sources:      sources,
+				cacheDir:     args.CacheDir,
+				libs:         map[string]bool{},
+				sourceDirs:   map[dirId]bool{},
+				lowerPaths:   readLowerPaths,
+				templateData: TemplateData{
+					Arch:    architecture,
+					Os:      os_,
+					Variant: variant,
+					Env:     envMap,
+					Labels:  labels,
+				},
 			}
-
-			index, err := readTarFsJson[imagespec.Index](tfs, "index.json")
-			if err != nil {
-				return err
+			if args.Reproducible {
+				layer = sortLayer(layer)
 			}
-			for _, m := range index.Manifests {
-				if m.MediaType != imagespec.MediaTypeImageManifest {
-					continue
+			for _, r := range layer.Remove {
+				err := writeDestWhiteout(dest, r)
+				if err != nil {
+					return err
 				}
-
-				manifest, err := readTarFsJson[imagespec.Manifest](tfs, blobPath(m.Digest))
+			}
+			for _, f := range layer.Files {
+				err := writeDestFile(dest, "", f)
 				if err != nil {
-					return fmt.Errorf("unable to find manifest %s referenced in tar index: %w", m.Digest, err)
+					return err
 				}
-				layerMetas = append(layerMetas, manifest.Layers...)
-				for _, layer := range manifest.Layers {
-					source, err := tfs.Open(blobPath(layer.Digest))
-					if err != nil {
-						return fmt.Errorf("error opening layer %s referenced in image manifest: %w", layer.Digest, err)
-					}
-					err = writeBlobReader(layer.Digest, layer.Size, source)
-					if err != nil {
-						return fmt.Errorf("error copying `from` layer %s to new image: %w", layer.Digest, err)
-					}
+			}
+			for _, d := range layer.Dirs {
+				err := buildDestDir(dest, "", d, nil)
+				if err != nil {
+					return err
 				}
-
-				fromConfig, err = readTarFsJson[imagespec.Image](tfs, blobPath(manifest.Config.Digest))
+			}
+			for _, n := range layer.Devices {
+				err := writeDestDevice(dest, "", n)
 				if err != nil {
-					return fmt.Errorf("unable to find config %s referenced in image manifest: %w", manifest.Config.Digest, err)
+					return err
+				}
+			}
+			if len(layer.Nix) != 0 {
+				if err := writeNixClosure(dest, layer.Nix); err != nil {
+					return err
+				}
+			}
+			if err := writeLibs(dest); err != nil {
+				return err
+			}
+			if user != nil {
+				if err := writeCreateUser(dest, *user); err != nil {
+					return err
+				}
+			}
+			if layer.IncludeCaCerts {
+				if err := writeCaCerts(dest, layer.CaCertsSource); err != nil {
+					return err
+				}
+			}
+			if args.Reproducible {
+				sort.SliceStable(dest.links, func(i, j int) bool {
+					return dest.links[i].Name < dest.links[j].Name
+				})
+			}
+			for _, l := range dest.links {
+				if dest.seen[l.Linkname] != tar.TypeReg {
+					return fmt.Errorf("hardlink %s target %s is not a regular file added in this layer", l.Name, l.Linkname)
+				}
+				if err := dest.writeHeader(l); err != nil {
+					return fmt.Errorf("error writing tar header for %s: %w", l.Name, err)
 				}
-				layerDiffIds = append(layerDiffIds, fromConfig.RootFS.DiffIDs...)
 			}
 			return nil
-		}(); err != nil {
-			return "", fmt.Errorf("error reading FROM image %s: %w", args.FromPath, err)
 		}
+		if args.MaxLayerSize == 0 {
+			return writeTarLayer(fill)
+		}
+
+		// Build the whole layer, then split it
+		fullTar, err := os.CreateTemp("", ".dinker-layer-full-*")
+		if err != nil {
+			return fmt.Errorf("error creating temp file for layer to split: %w", err)
+		}
+		defer os.Remove(fullTar.Name())
+		defer fullTar.Close()
+		fullTarWriter := tar.NewWriter(fullTar)
+		if err := fill(fullTarWriter); err != nil {
+			return err
+		}
+		if err := fullTarWriter.Close(); err != nil {
+			return fmt.Errorf("error closing layer tar: %w", err)
+		}
+		if _, err := fullTar.Seek(0, 0); err != nil {
+			panic(err)
+		}
+		parts, err := splitLayerTar(ctx, fullTar, args.MaxLayerSize)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			for _, p := range parts {
+				os.Remove(p)
+			}
+		}()
+		for i, p := range parts {
+			if i > 0 {
+				onEvent(BuildEvent{Kind: BuildEventLayerStart})
+			}
+			if err := writeTarLayer(func(destTar *tar.Writer) error {
+				return copyTarEntries(ctx, p, destTar)
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
-	env := []string{}
-	if !args.ClearEnv {
-		env = append(env, fromConfig.Config.Env...)
+
+	for i, layer := range args.Layers {
+		if layer.Tar != "" {
+			if err := writePrebuiltLayer(layer.Tar); err != nil {
+				return "", fmt.Errorf("error adding prebuilt layer %s: %w", layer.Tar, err)
+			}
+		} else {
+			if err := writeBuiltLayer(layer, nil); err != nil {
+				return "", fmt.Errorf("error building layer %d: %w", i, err)
+			}
+		}
 	}
-	for k, v := range args.AddEnv {
-		env = append(env, fmt.Sprintf("%s=%s", k, v))
+
+	// Write own layer, unless there's nothing in it and other layers were added
+	ownLayer := BuildImageArgsLayer{
+		Dirs:           args.Dirs,
+		Files:          args.Files,
+		Devices:        args.Devices,
+		Remove:         args.Remove,
+		Nix:            args.Nix,
+		IncludeCaCerts: args.IncludeCaCerts,
+		CaCertsSource:  args.CaCertsSource,
 	}
-	sort.Slice(env, func(i int, j int) bool {
-		return env[i] < env[j]
-	})
+	var ownUser *createUser
+	if args.CreateUser != nil {
+		if args.FromPath != "" || args.FromRootfs != "" {
+			return "", fmt.Errorf("creating a user would replace the FROM image's /etc/passwd and /etc/group")
+		}
+		u, err := resolveCreateUser(*args.CreateUser, args.User)
+		if err != nil {
+			return "", err
+		}
+		ownUser = &u
+	}
+	if len(args.Layers) == 0 || len(ownLayer.Files) != 0 || len(ownLayer.Dirs) != 0 || len(ownLayer.Devices) != 0 || len(ownLayer.Remove) != 0 || len(ownLayer.Nix) != 0 || ownLayer.IncludeCaCerts || ownUser != nil {
+		if err := writeBuiltLayer(ownLayer, ownUser); err != nil {
+			return "", err
+		}
+	}
+
+	// Merge everything into a single layer, replacing the layers collected above
+	if args.Squash {
+		squashing = false
+		layerMetas = []imagespec.Descriptor{}
+		layerDiffIds = []digest.Digest{}
+		onEvent(BuildEvent{Kind: BuildEventLayerStart})
+		if err := writeTarLayer(func(destTar *tar.Writer) error {
+			return writeSquashedTar(ctx, destTar, args.Reproducible, squashSources)
+		}); err != nil {
+			return "", fmt.Errorf("error writing squashed layer: %w", err)
+		}
+	}
+
+	if sbomFiles != nil {
+		if err := writeSbom(args.SbomPath, args.SbomName, args.Created, *sbomFiles, args.SbomPackages); err != nil {
+			return "", err
+		}
+	}
+
 	ports := map[string]struct{}{}
-	if len(args.Ports) != 0 {
-		for _, p := range args.Ports {
-			ports[fmt.Sprintf("%d/%s", p.Port, Def(p.Transport, "tcp"))] = struct{}{}
+	if !args.ClearPorts {
+		for p := range fromConfig.Config.ExposedPorts {
+			ports[p] = struct{}{}
+		}
+	}
+	for _, p := range args.RemovePorts {
+		keys, err := p.keys()
+		if err != nil {
+			return "", err
+		}
+		for _, k := range keys {
+			delete(ports, k)
+		}
+	}
+	for _, p := range args.Ports {
+		keys, err := p.keys()
+		if err != nil {
+			return "", err
+		}
+		for _, k := range keys {
+			ports[k] = struct{}{}
+		}
+	}
+
+	// Like Docker, setting the entrypoint resets the inherited cmd
+	entrypoint := args.Entrypoint
+	cmd := args.Cmd
+	if len(entrypoint) == 0 && !args.ClearEntrypoint {
+		entrypoint = fromConfig.Config.Entrypoint
+		if len(cmd) == 0 && !args.ClearCmd {
+			cmd = fromConfig.Config.Cmd
+		}
+	}
+
+	volumes := map[string]struct{}{}
+	if !args.ClearVolumes {
+		for v := range fromConfig.Config.Volumes {
+			volumes[v] = struct{}{}
 		}
 	}
+	for _, v := range args.RemoveVolumes {
+		delete(volumes, v)
+	}
+	for _, v := range args.Volumes {
+		volumes[v] = struct{}{}
+	}
+
+	stopSignal := args.StopSignal
+	if stopSignal == "" && !args.ClearStopSignal {
+		stopSignal = fromConfig.Config.StopSignal
+	}
+	workingDir := args.WorkingDir
+	if workingDir == "" && !args.ClearWorkingDir {
+		workingDir = fromConfig.Config.WorkingDir
+	}
+	user := args.User
+	if user == "" && !args.ClearUser {
+		user = fromConfig.Config.User
+	}
+	shell := args.Shell
+	if len(shell) == 0 {
+		shell = fromConfig.Config.Shell
+	}
+
+	var created *time.Time
+	if !args.Created.IsZero() {
+		created = &args.Created
+	}
 
 	// Write remaining meta files
-	imageConfigDigest, imageConfig := buildJson(imagespec.Image{
-		Platform: imagespec.Platform{
-			Architecture: Def(args.Architecture, fromConfig.Architecture),
-			OS:           Def(args.Os, fromConfig.OS),
-		},
-		Config: imagespec.ImageConfig{
-			Env:          env,
-			WorkingDir:   Def(args.WorkingDir, fromConfig.Config.WorkingDir),
-			User:         Def(args.User, fromConfig.Config.User),
-			Entrypoint:   args.Entrypoint,
-			Cmd:          args.Cmd,
-			ExposedPorts: ports,
-			StopSignal:   args.StopSignal,
-			Labels:       args.Labels,
+	imageConfigDigest, imageConfig := buildJson(dockerImage{
+		Image: imagespec.Image{
+			Created: created,
+			Author:  args.Author,
+			Platform: imagespec.Platform{
+				Architecture: architecture,
+				OS:           os_,
+				Variant:      variant,
+				OSVersion:    osVersion,
+				OSFeatures:   osFeatures,
+			},
+			RootFS: imagespec.RootFS{
+				Type:    "layers",
+				DiffIDs: layerDiffIds,
+			},
 		},
-		RootFS: imagespec.RootFS{
-			Type:    "layers",
-			DiffIDs: layerDiffIds,
+		Config: dockerImageConfig{
+			ImageConfig: imagespec.ImageConfig{
+				Env:          env,
+				WorkingDir:   workingDir,
+				User:         user,
+				Entrypoint:   entrypoint,
+				Cmd:          cmd,
+				ExposedPorts: ports,
+				Volumes:      volumes,
+				StopSignal:   stopSignal,
+				Labels:       labels,
+			},
+			Shell: shell,
 		},
 	})
 	if err := writeBlob(imageConfigDigest, imageConfig); err != nil {
@@ -385,9 +1729,19 @@ func BuildImage(args BuildImageArgs) (hash string, err error) {
 			Digest:    imageConfigDigest,
 			Size:      int64(len(imageConfig)),
 		},
-		Layers: layerMetas,
+		Layers:      layerMetas,
+		Subject:     args.Subject,
+		Annotations: args.Annotations,
 	})
-	if err := writeBlob(imageManifestDigest, imageManifest); err != nil {
+	if args.Dest != nil {
+		if err := args.Dest.PutManifest(ctx, imageManifest); err != nil {
+			return "", fmt.Errorf("error writing manifest: %w", err)
+		}
+		// Only for the hash, so it's the same as when writing a layout
+		if err := writeMemory(blobPath(imageManifestDigest), imageManifest); err != nil {
+			return "", err
+		}
+	} else if err := writeBlob(imageManifestDigest, imageManifest); err != nil {
 		return "", err
 	}
 	if err := writeJson("index.json", imagespec.Index{
@@ -405,6 +1759,12 @@ func BuildImage(args BuildImageArgs) (hash string, err error) {
 		return "", err
 	}
 
+	onEvent(BuildEvent{
+		Kind:   BuildEventDone,
+		Digest: imageManifestDigest,
+		Size:   int64(len(imageManifest)),
+	})
+
 	hash1 := sha256.Sum256(canonicalJsonMarshal(hashData))
 	return hex.EncodeToString(hash1[:]), nil
 }
@@ -0,0 +1,81 @@
+package dinkerlib
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+)
+
+var sha256Regex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Download a url file source, verifying it against the expected sha256 (hex).
+// If cacheDir is specified the file is kept there and reused in later builds.
+// Otherwise it's downloaded to a temporary file, which is deleted by the returned
+// cleanup function.
+func downloadSource(ctx context.Context, cacheDir AbsPath, url AbsPath, wantSha256 string) (AbsPath, func(), error) {
+	cleanup := func() {}
+	if !sha256Regex.MatchString(wantSha256) {
+		return "", nil, fmt.Errorf("url source %s must have a sha256 (64 lowercase hex characters)", url)
+	}
+	var dir string
+	if cacheDir != "" {
+		cached := cacheDir.Join("downloads").Join("sha256-" + wantSha256)
+		if cached.Exists() {
+			return cached, cleanup, nil
+		}
+		dir = cached.Parent().Raw()
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return "", nil, fmt.Errorf("error creating download cache dir %s: %w", dir, err)
+		}
+	}
+	f, err := os.CreateTemp(dir, ".dinker-download-*")
+	if err != nil {
+		return "", nil, fmt.Errorf("error creating temp file for downloading %s: %w", url, err)
+	}
+	remove := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url.Raw(), nil)
+	if err != nil {
+		remove()
+		return "", nil, fmt.Errorf("invalid url source %s: %w", url, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		remove()
+		return "", nil, fmt.Errorf("error downloading %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		remove()
+		return "", nil, fmt.Errorf("error downloading %s: server responded %s", url, resp.Status)
+	}
+	digester := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, digester), ctxReader{ctx, resp.Body}); err != nil {
+		remove()
+		return "", nil, fmt.Errorf("error downloading %s: %w", url, err)
+	}
+	if err := f.Close(); err != nil {
+		remove()
+		return "", nil, fmt.Errorf("error closing downloaded %s: %w", url, err)
+	}
+	if gotSha256 := hex.EncodeToString(digester.Sum(nil)); gotSha256 != wantSha256 {
+		remove()
+		return "", nil, fmt.Errorf("downloaded %s has sha256 %s but expected %s", url, gotSha256, wantSha256)
+	}
+	if cacheDir == "" {
+		return AbsPath(f.Name()), remove, nil
+	}
+	cached := cacheDir.Join("downloads").Join("sha256-" + wantSha256)
+	if err := os.Rename(f.Name(), cached.Raw()); err != nil {
+		remove()
+		return "", nil, fmt.Errorf("error moving downloaded %s into the cache: %w", url, err)
+	}
+	return cached, cleanup, nil
+}
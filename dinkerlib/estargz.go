@@ -0,0 +1,56 @@
+package dinkerlib
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/opencontainers/go-digest"
+)
+
+// Converts the tar stream written to it to estargz. Since the estargz writer
+// consumes a reader, the conversion happens in a separate goroutine.
+type estargzWriter struct {
+	pipe   *io.PipeWriter
+	done   chan error
+	writer *estargz.Writer
+	// Available after close
+	tocDigest digest.Digest
+	diffId    digest.Digest
+}
+
+func newEstargzWriter(w io.Writer) *estargzWriter {
+	pipeReader, pipeWriter := io.Pipe()
+	out := &estargzWriter{
+		pipe:   pipeWriter,
+		done:   make(chan error, 1),
+		writer: estargz.NewWriter(w),
+	}
+	go func() {
+		err := out.writer.AppendTar(pipeReader)
+		// Unblock writes if conversion stopped early
+		pipeReader.CloseWithError(err)
+		out.done <- err
+	}()
+	return out
+}
+
+func (w *estargzWriter) Write(p []byte) (int, error) {
+	return w.pipe.Write(p)
+}
+
+func (w *estargzWriter) Close() error {
+	if err := w.pipe.Close(); err != nil {
+		return err
+	}
+	if err := <-w.done; err != nil {
+		return fmt.Errorf("error converting layer to estargz: %w", err)
+	}
+	tocDigest, err := w.writer.Close()
+	if err != nil {
+		return fmt.Errorf("error finishing estargz layer: %w", err)
+	}
+	w.tocDigest = tocDigest
+	w.diffId = digest.Digest(w.writer.DiffID())
+	return nil
+}
@@ -0,0 +1,76 @@
+package dinkerlib
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Patterns of paths to skip when copying a source dir
+type sourceExcludes struct {
+	// Source path (see sourcePath) of the dir the patterns are relative to
+	root     string
+	patterns [][]string
+}
+
+func newSourceExcludes(source AbsPath, patterns []string) (*sourceExcludes, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	out := &sourceExcludes{root: sourcePath(source)}
+	for _, p := range patterns {
+		segments := strings.Split(strings.Trim(path.Clean(p), "/"), "/")
+		for _, s := range segments {
+			if _, err := path.Match(s, ""); err != nil {
+				return nil, fmt.Errorf("invalid exclude pattern %s: %w", p, err)
+			}
+		}
+		out.patterns = append(out.patterns, segments)
+	}
+	return out, nil
+}
+
+// Whether `p` (a source path within the root) matches any pattern
+func (e *sourceExcludes) excluded(p string) bool {
+	if e == nil {
+		return false
+	}
+	rel := p
+	if e.root != "." {
+		var found bool
+		rel, found = strings.CutPrefix(p, e.root+"/")
+		if !found {
+			return false
+		}
+	}
+	relSegments := strings.Split(rel, "/")
+	for _, pattern := range e.patterns {
+		if matchExclude(pattern, relSegments) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match path segments against pattern segments, where `**` matches any number of
+// segments and others are matched with path.Match
+func matchExclude(pattern []string, p []string) bool {
+	if len(pattern) == 0 {
+		return len(p) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(p); i++ {
+			if matchExclude(pattern[1:], p[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(p) == 0 {
+		return false
+	}
+	if matched, _ := path.Match(pattern[0], p[0]); !matched {
+		return false
+	}
+	return matchExclude(pattern[1:], p[1:])
+}
@@ -0,0 +1,89 @@
+package dinkerlib
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// Check the git source fields, returning the cleaned subpath
+func checkGitSource(g BuildImageArgsGit) (string, error) {
+	if g.Url == "" {
+		return "", fmt.Errorf("git source is missing a url")
+	}
+	if g.Ref == "" {
+		return "", fmt.Errorf("git source %s is missing a ref", g.Url)
+	}
+	subpath := strings.Trim(path.Clean("/"+g.Path), "/")
+	if g.Path != "" && subpath != strings.Trim(path.Clean(g.Path), "/") {
+		return "", fmt.Errorf("git source %s path %s is outside of the repo", g.Url, g.Path)
+	}
+	return subpath, nil
+}
+
+func runGit(ctx context.Context, dir string, args ...string) error {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	// Fail instead of waiting for credentials
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("git %s failed: %w\n%s", strings.Join(args, " "), err, out)
+	}
+	return nil
+}
+
+// Check out the git source into a new temp dir, returning the dir to copy from
+// (the repo or its subpath). The returned cleanup function deletes the checkout.
+func checkoutGitSource(ctx context.Context, g BuildImageArgsGit) (AbsPath, func(), error) {
+	subpath, err := checkGitSource(g)
+	if err != nil {
+		return "", nil, err
+	}
+	dir, err := os.MkdirTemp("", ".dinker-git-*")
+	if err != nil {
+		return "", nil, fmt.Errorf("error creating temp dir for git checkout: %w", err)
+	}
+	cleanup := func() {
+		os.RemoveAll(dir)
+	}
+	if err := runGit(ctx, dir, "init", "--quiet"); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	if err := runGit(ctx, dir, "remote", "add", "origin", g.Url); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	// Fetching just the ref is fastest, but some servers don't allow fetching
+	// commits by hash so fall back to fetching everything
+	if err := runGit(ctx, dir, "fetch", "--quiet", "--depth", "1", "origin", g.Ref); err == nil {
+		err = runGit(ctx, dir, "checkout", "--quiet", "--detach", "FETCH_HEAD")
+		if err != nil {
+			cleanup()
+			return "", nil, err
+		}
+	} else {
+		if err := runGit(ctx, dir, "fetch", "--quiet", "--tags", "origin", "+refs/heads/*:refs/remotes/origin/*"); err != nil {
+			cleanup()
+			return "", nil, fmt.Errorf("error fetching git source %s: %w", g.Url, err)
+		}
+		if err := runGit(ctx, dir, "checkout", "--quiet", "--detach", g.Ref); err != nil {
+			cleanup()
+			return "", nil, fmt.Errorf("error checking out %s of git source %s: %w", g.Ref, g.Url, err)
+		}
+	}
+	source := AbsPath(dir)
+	if subpath != "" {
+		source = source.Join(subpath)
+	}
+	stat, err := os.Stat(source.Raw())
+	if err != nil || !stat.IsDir() {
+		cleanup()
+		return "", nil, fmt.Errorf("git source %s path %s isn't a dir at %s", g.Url, g.Path, g.Ref)
+	}
+	return source, cleanup, nil
+}
@@ -0,0 +1,18 @@
+package dinkerlib
+
+import (
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// An image config with the Docker extensions to the OCI config that dinker
+// inherits and sets
+type dockerImage struct {
+	imagespec.Image
+	Config dockerImageConfig `json:"config,omitempty"`
+}
+
+type dockerImageConfig struct {
+	imagespec.ImageConfig
+	// Used by Docker for shell form RUN, CMD, and ENTRYPOINT in later builds
+	Shell []string `json:"Shell,omitempty"`
+}
@@ -0,0 +1,101 @@
+package dinkerlib
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Build an image per platform into the same layout, then replace the layout index
+// with a single image index referencing all of them (so it can be copied as one
+// image)
+func buildImageIndex(ctx context.Context, args BuildImageArgs) (hash string, err error) {
+	layout := os.DirFS(args.DestDirPath.Raw())
+	hashes := []string{}
+	manifests := []imagespec.Descriptor{}
+	for _, platform := range args.Platforms {
+		platformArgs := args
+		platformArgs.Platforms = nil
+		platformArgs.Subject = nil
+		platformArgs.Architecture = Def(platform.Architecture, args.Architecture)
+		platformArgs.Os = Def(platform.Os, args.Os)
+		platformArgs.Variant = Def(platform.Variant, args.Variant)
+		platformArgs.OsVersion = Def(platform.OsVersion, args.OsVersion)
+		if platform.OsFeatures != nil {
+			platformArgs.OsFeatures = platform.OsFeatures
+		}
+		platformArgs.FromPath = Def(platform.FromPath, args.FromPath)
+		platformArgs.FromRootfs = Def(platform.FromRootfs, args.FromRootfs)
+		if args.OnEvent != nil {
+			args.OnEvent(BuildEvent{
+				Kind:     BuildEventPlatform,
+				Platform: strings.TrimSuffix(platformArgs.Os+"/"+platformArgs.Architecture+"/"+platformArgs.Variant, "/"),
+			})
+		}
+		platformHash, err := buildImage(ctx, platformArgs)
+		if err != nil {
+			return "", fmt.Errorf("error building image for platform %s/%s: %w", platformArgs.Os, platformArgs.Architecture, err)
+		}
+		hashes = append(hashes, platformHash)
+
+		// Add the platform (from the built config, since it may be inherited from FROM)
+		platformIndex, err := readTarFsJson[imagespec.Index](layout, "index.json")
+		if err != nil {
+			return "", err
+		}
+		m := platformIndex.Manifests[0]
+		manifest, err := readTarFsJson[imagespec.Manifest](layout, blobPath(m.Digest))
+		if err != nil {
+			return "", err
+		}
+		config, err := readTarFsJson[imagespec.Image](layout, blobPath(manifest.Config.Digest))
+		if err != nil {
+			return "", err
+		}
+		m.Platform = &config.Platform
+		for _, other := range manifests {
+			if other.Platform.OS == m.Platform.OS && other.Platform.Architecture == m.Platform.Architecture && other.Platform.Variant == m.Platform.Variant && other.Platform.OSVersion == m.Platform.OSVersion {
+				return "", fmt.Errorf("multiple platforms build images for os [%s] arch [%s] variant [%s]", m.Platform.OS, m.Platform.Architecture, m.Platform.Variant)
+			}
+		}
+		manifests = append(manifests, m)
+	}
+
+	index := canonicalJsonMarshal(imagespec.Index{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		MediaType:   imagespec.MediaTypeImageIndex,
+		Manifests:   manifests,
+		Subject:     args.Subject,
+		Annotations: args.Annotations,
+	})
+	indexDigest := digest.FromBytes(index)
+	if err := os.WriteFile(args.DestDirPath.Join(blobPath(indexDigest)).Raw(), index, 0o600); err != nil {
+		return "", fmt.Errorf("error writing image index: %w", err)
+	}
+	if err := os.WriteFile(args.DestDirPath.Join("index.json").Raw(), canonicalJsonMarshal(imagespec.Index{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		Manifests: []imagespec.Descriptor{
+			{
+				MediaType: imagespec.MediaTypeImageIndex,
+				Digest:    indexDigest,
+				Size:      int64(len(index)),
+			},
+		},
+	}), 0o600); err != nil {
+		return "", fmt.Errorf("error writing layout index: %w", err)
+	}
+
+	hash1 := sha256.Sum256(canonicalJsonMarshal(hashes))
+	return hex.EncodeToString(hash1[:]), nil
+}
@@ -0,0 +1,236 @@
+package dinkerlib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"syscall"
+)
+
+// Hash the arguments and the contents of every file they reference, without
+// building anything. If the hash is the same as for a previous build, the built
+// image will be the same too.
+func HashBuildInputs(args BuildImageArgs) (string, error) {
+	return hashBuildInputs(args, true)
+}
+
+// Like HashBuildInputs, but only hashes the metadata (size, modification time) of
+// referenced files instead of their contents. This is much faster, for detecting
+// changes frequently, but may change when the built image wouldn't.
+func StatBuildInputs(args BuildImageArgs) (string, error) {
+	return hashBuildInputs(args, false)
+}
+
+func hashBuildInputs(args BuildImageArgs, contents bool) (string, error) {
+	h := sha256.New()
+	hashArgs := args
+	// Only affect where things are written
+	hashArgs.DestDirPath = ""
+	hashArgs.CacheDir = ""
+	hashArgs.CompressionThreads = 0
+	_, _ = h.Write(canonicalJsonMarshal(hashArgs))
+
+	hostPaths := []AbsPath{args.FromPath, args.FromRootfs}
+	hostPaths = append(hostPaths, args.CopyFrom...)
+	for _, p := range args.Platforms {
+		hostPaths = append(hostPaths, p.FromPath, p.FromRootfs)
+	}
+	sourcePaths := []AbsPath{}
+	sourceExcludes := map[AbsPath][]string{}
+	libFiles := []BuildImageArgsFile{}
+	addLayer := func(l BuildImageArgsLayer) {
+		libFiles = appendIncludeLibsFiles(libFiles, l.Files, l.Dirs)
+		hostPaths = append(hostPaths, l.Tar)
+		// Store paths are immutable and reference their dependencies by hash, so
+		// hashing the top paths covers the closure
+		hostPaths = append(hostPaths, l.Nix...)
+		hostPaths = append(hostPaths, l.CaCertsSource)
+		for _, d := range l.Dirs {
+			sourcePaths = appendDirInputs(sourcePaths, sourceExcludes, d)
+		}
+		for _, f := range l.Files {
+			sourcePaths = appendFileInputs(sourcePaths, f)
+		}
+	}
+	for _, l := range args.Layers {
+		addLayer(l)
+	}
+	addLayer(BuildImageArgsLayer{Dirs: args.Dirs, Files: args.Files, Nix: args.Nix, CaCertsSource: args.CaCertsSource})
+	hostFs := os.DirFS("/")
+	sources := args.SourceFS
+	if sources == nil {
+		sources = hostFs
+	}
+	for _, f := range libFiles {
+		hostPaths = append(hostPaths, includeLibsInputs(sources, f)...)
+	}
+	for _, p := range hostPaths {
+		if p == "" {
+			continue
+		}
+		if err := hashInput(h, hostFs, p, nil, contents, map[dirId]bool{}); err != nil {
+			return "", err
+		}
+	}
+	for _, p := range sourcePaths {
+		if p == "" {
+			continue
+		}
+		excludes, err := newSourceExcludes(p, sourceExcludes[p])
+		if err != nil {
+			return "", err
+		}
+		if err := hashInput(h, sources, p, excludes, contents, map[dirId]bool{}); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func appendFileInputs(paths []AbsPath, f BuildImageArgsFile) []AbsPath {
+	// Url sources are pinned by sha256 in the args
+	if !f.Source.IsUrl() {
+		paths = append(paths, f.Source)
+	}
+	paths = append(paths, f.Template)
+	keys := []string{}
+	for k := range f.PlatformSources {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		paths = append(paths, f.PlatformSources[k])
+	}
+	return paths
+}
+
+func appendIncludeLibsFiles(out []BuildImageArgsFile, files []BuildImageArgsFile, dirs []BuildImageArgsDir) []BuildImageArgsFile {
+	for _, f := range files {
+		if f.IncludeLibs {
+			out = append(out, f)
+		}
+	}
+	for _, d := range dirs {
+		out = appendIncludeLibsFiles(out, d.Files, d.Dirs)
+	}
+	return out
+}
+
+// The host libraries added for a file with include_libs. Libraries that can't be
+// resolved are skipped, the build reports them.
+func includeLibsInputs(sources fs.FS, f BuildImageArgsFile) []AbsPath {
+	fileSources := []AbsPath{f.Source}
+	keys := []string{}
+	for k := range f.PlatformSources {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fileSources = append(fileSources, f.PlatformSources[k])
+	}
+	out := []AbsPath{}
+	for _, s := range fileSources {
+		if s == "" || s.IsUrl() {
+			continue
+		}
+		matches := []string{sourcePath(s)}
+		if isGlobSource(sources, s) {
+			matches, _ = fs.Glob(sources, sourcePath(s))
+		}
+		for _, m := range matches {
+			libs, err := elfLibs(sources, AbsPath("/"+m))
+			if err != nil {
+				continue
+			}
+			for _, l := range libs {
+				out = append(out, AbsPath(l))
+			}
+		}
+	}
+	return out
+}
+
+// Exclude patterns for source dirs are added to `excludes`
+func appendDirInputs(paths []AbsPath, excludes map[AbsPath][]string, d BuildImageArgsDir) []AbsPath {
+	paths = append(paths, d.Source)
+	if d.Source != "" && len(d.Exclude) != 0 {
+		excludes[d.Source] = append(excludes[d.Source], d.Exclude...)
+	}
+	for _, d1 := range d.Dirs {
+		paths = appendDirInputs(paths, excludes, d1)
+	}
+	for _, f := range d.Files {
+		paths = appendFileInputs(paths, f)
+	}
+	return paths
+}
+
+// Hash the names, types, and contents (or modification times) of the files at `p`
+// (a file, glob, or dir), skipping excluded paths. `ancestors` are the symlinked
+// dirs being hashed, to detect loops.
+func hashInput(h hash.Hash, fsys fs.FS, p AbsPath, excludes *sourceExcludes, contents bool, ancestors map[dirId]bool) error {
+	matches := []string{sourcePath(p)}
+	if isGlobSource(fsys, p) {
+		var err error
+		matches, err = fs.Glob(fsys, sourcePath(p))
+		if err != nil {
+			return fmt.Errorf("invalid glob source %s: %w", p, err)
+		}
+	}
+	for _, m := range matches {
+		err := fs.WalkDir(fsys, m, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return fmt.Errorf("error reading build input %s: %w", path, err)
+			}
+			if excludes.excluded(path) {
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			// Sources are read following symlinks
+			info, err := fs.Stat(fsys, path)
+			if err != nil {
+				return fmt.Errorf("error looking up metadata for build input %s: %w", path, err)
+			}
+			_, _ = fmt.Fprintf(h, "%s\x00%s\x00%d\x00", path, info.Mode(), info.Size())
+			// For preserve_owner
+			if sys, ok := info.Sys().(*syscall.Stat_t); ok {
+				_, _ = fmt.Fprintf(h, "%d\x00%d\x00", sys.Uid, sys.Gid)
+			}
+			if info.IsDir() && d.Type()&fs.ModeSymlink != 0 {
+				leave, err := enterSourceDir(ancestors, info, AbsPath("/"+path))
+				if err != nil {
+					return err
+				}
+				defer leave()
+				return hashInput(h, fsys, AbsPath(path), excludes, contents, ancestors)
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			if !contents {
+				_, _ = fmt.Fprintf(h, "%d\x00", info.ModTime().UnixNano())
+				return nil
+			}
+			f, err := fsys.Open(path)
+			if err != nil {
+				return fmt.Errorf("error opening build input %s: %w", path, err)
+			}
+			defer f.Close()
+			if _, err := io.Copy(h, f); err != nil {
+				return fmt.Errorf("error reading build input %s: %w", path, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,292 @@
+package dinkerlib
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Searched after rpath/runpath and the ld.so.conf dirs, like the dynamic linker
+var defaultLibDirs = []string{"/lib64", "/usr/lib64", "/lib", "/usr/lib"}
+
+// Dirs listed in an ld.so.conf, following includes
+func ldSoConfDirs(confPath string, seen map[string]bool) []string {
+	if seen[confPath] {
+		return nil
+	}
+	seen[confPath] = true
+	f, err := os.Open(confPath)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	dirs := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if include, ok := strings.CutPrefix(line, "include"); ok && strings.TrimSpace(include) != include {
+			for _, pattern := range strings.Fields(include) {
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(filepath.Dir(confPath), pattern)
+				}
+				matches, _ := filepath.Glob(pattern)
+				sort.Strings(matches)
+				for _, m := range matches {
+					dirs = append(dirs, ldSoConfDirs(m, seen)...)
+				}
+			}
+			continue
+		}
+		dirs = append(dirs, line)
+	}
+	return dirs
+}
+
+// An ELF file's dynamic linking info
+type elfDeps struct {
+	class   elf.Class
+	machine elf.Machine
+	interp  string
+	soname  string
+	needed  []string
+	// Search dirs from DT_RPATH or DT_RUNPATH, with $ORIGIN expanded
+	searchDirs []string
+}
+
+func readElfDeps(r io.ReaderAt, origin string) (*elfDeps, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	deps := &elfDeps{
+		class:   f.Class,
+		machine: f.Machine,
+	}
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_INTERP {
+			continue
+		}
+		interp, err := io.ReadAll(p.Open())
+		if err != nil {
+			return nil, fmt.Errorf("error reading interpreter: %w", err)
+		}
+		deps.interp = string(bytes.TrimRight(interp, "\x00"))
+	}
+	if f.Section(".dynamic") == nil {
+		return deps, nil
+	}
+	soname, err := f.DynString(elf.DT_SONAME)
+	if err != nil {
+		return nil, fmt.Errorf("error reading soname: %w", err)
+	}
+	if len(soname) != 0 {
+		deps.soname = soname[0]
+	}
+	deps.needed, err = f.DynString(elf.DT_NEEDED)
+	if err != nil {
+		return nil, fmt.Errorf("error reading needed libraries: %w", err)
+	}
+	// Runpath takes precedence over rpath if present
+	rpath, err := f.DynString(elf.DT_RUNPATH)
+	if err != nil {
+		return nil, fmt.Errorf("error reading runpath: %w", err)
+	}
+	if len(rpath) == 0 {
+		rpath, err = f.DynString(elf.DT_RPATH)
+		if err != nil {
+			return nil, fmt.Errorf("error reading rpath: %w", err)
+		}
+	}
+	for _, r := range rpath {
+		for _, d := range strings.Split(r, ":") {
+			d = strings.ReplaceAll(d, "${ORIGIN}", origin)
+			d = strings.ReplaceAll(d, "$ORIGIN", origin)
+			if d != "" {
+				deps.searchDirs = append(deps.searchDirs, d)
+			}
+		}
+	}
+	return deps, nil
+}
+
+func readHostElfDeps(p string) (*elfDeps, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readElfDeps(f, filepath.Dir(p))
+}
+
+// Get the host paths of the dynamic linker and the shared libraries (recursively)
+// needed by the ELF binary `source`, sorted. Libraries are resolved on the host
+// like the dynamic linker would, skipping libraries for other architectures.
+// Returns nothing for static binaries.
+func elfLibs(sources fs.FS, source AbsPath) ([]string, error) {
+	f, err := sources.Open(sourcePath(source))
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s to look up shared libraries: %w", source, err)
+	}
+	defer f.Close()
+	r, ok := f.(io.ReaderAt)
+	if !ok {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s to look up shared libraries: %w", source, err)
+		}
+		r = bytes.NewReader(data)
+	}
+	root, err := readElfDeps(r, path.Dir(source.Raw()))
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s as an ELF binary: %w", source, err)
+	}
+
+	confDirs := ldSoConfDirs("/etc/ld.so.conf", map[string]bool{})
+	found := map[string]bool{}
+	// Libraries are only loaded once per name or soname (ex: the dynamic linker)
+	resolved := map[string]bool{}
+	resolve := func(name string, from *elfDeps) (string, error) {
+		if strings.Contains(name, "/") {
+			return name, nil
+		}
+		for _, dirs := range [][]string{from.searchDirs, confDirs, defaultLibDirs} {
+			for _, d := range dirs {
+				candidate := filepath.Join(d, name)
+				deps, err := readHostElfDeps(candidate)
+				if err != nil {
+					// Missing or not an ELF file
+					continue
+				}
+				if deps.class != root.class || deps.machine != root.machine {
+					continue
+				}
+				return candidate, nil
+			}
+		}
+		return "", fmt.Errorf("couldn't find shared library %s needed by %s for %s %s on the host", name, source, root.class, root.machine)
+	}
+	var add func(name string, from *elfDeps) error
+	add = func(name string, from *elfDeps) error {
+		if resolved[name] {
+			return nil
+		}
+		resolved[name] = true
+		p, err := resolve(name, from)
+		if err != nil {
+			return err
+		}
+		found[p] = true
+		deps, err := readHostElfDeps(p)
+		if err != nil {
+			return fmt.Errorf("error reading shared library %s: %w", p, err)
+		}
+		if deps.soname != "" {
+			resolved[deps.soname] = true
+		}
+		for _, n := range deps.needed {
+			if err := add(n, deps); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if root.interp != "" {
+		if err := add(root.interp, root); err != nil {
+			return nil, err
+		}
+	}
+	for _, n := range root.needed {
+		if err := add(n, root); err != nil {
+			return nil, err
+		}
+	}
+	out := []string{}
+	for p := range found {
+		out = append(out, p)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// Write parent dirs of a path that aren't already in the layer or the layers
+// below. Existing paths are left as is so symlinks (ex: `lib` to `usr/lib` in
+// usr-merged images) aren't replaced, along with everything under them.
+func writeParentDirs(dest *destLayer, destPath string) error {
+	lower, err := dest.lowerPaths()
+	if err != nil {
+		return err
+	}
+	parts := strings.Split(destPath, "/")
+	for i := 1; i < len(parts); i++ {
+		p := strings.Join(parts[:i], "/")
+		if dest.seen[p] == tar.TypeDir {
+			continue
+		}
+		if t, found := lower[p]; found {
+			if t == tar.TypeSymlink {
+				return nil
+			}
+			continue
+		}
+		if _, seen := dest.seen[p]; seen {
+			return fmt.Errorf("the layer tar file has %s, which isn't a dir, and %s", p, destPath)
+		}
+		dest.seen[p] = tar.TypeDir
+		if err := dest.writeHeader(&tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     p,
+			Mode:     0o755,
+			ModTime:  dest.mtime,
+		}); err != nil {
+			return fmt.Errorf("error writing tar header for %s: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// Add the shared libraries collected from files with `include_libs` at their host
+// paths
+func writeLibs(dest *destLayer) error {
+	libs := []string{}
+	for p := range dest.libs {
+		libs = append(libs, p)
+	}
+	sort.Strings(libs)
+	// Libraries are on the host, not in the sources fs
+	parentSources := dest.sources
+	dest.sources = os.DirFS("/")
+	defer func() {
+		dest.sources = parentSources
+	}()
+	for _, p := range libs {
+		destPath := strings.TrimPrefix(filepath.Clean(p), "/")
+		if err := writeParentDirs(dest, destPath); err != nil {
+			return err
+		}
+		parentPath := path.Dir(destPath)
+		if parentPath == "." {
+			parentPath = ""
+		}
+		if err := writeDestFile0(dest, parentPath, BuildImageArgsFile{
+			Source: AbsPath(p),
+			Mode:   modePreserve,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package dinkerlib
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const nixStoreDir = "/nix/store"
+
+// Get the runtime closure of nix store paths (the paths and everything they
+// reference, recursively), sorted
+func nixClosure(ctx context.Context, paths []AbsPath) ([]string, error) {
+	args := []string{"--query", "--requisites"}
+	for _, p := range paths {
+		args = append(args, p.Raw())
+	}
+	out, err := exec.CommandContext(ctx, "nix-store", args...).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("error getting nix closure: %w\n%s", err, exitErr.Stderr)
+		}
+		return nil, fmt.Errorf("error getting nix closure: %w", err)
+	}
+	closure := strings.Fields(string(out))
+	sort.Strings(closure)
+	return closure, nil
+}
+
+// Add the closures of nix store paths to the layer at their paths in `/nix/store`.
+// Symlinks are kept as symlinks, and modes are taken from the store.
+func writeNixClosure(dest *destLayer, paths []AbsPath) error {
+	closure, err := nixClosure(dest.ctx, paths)
+	if err != nil {
+		return err
+	}
+	// Store files are on the host, not in the sources fs
+	parentSources := dest.sources
+	dest.sources = os.DirFS("/")
+	defer func() {
+		dest.sources = parentSources
+	}()
+	for _, storePath := range closure {
+		if filepath.Dir(storePath) != nixStoreDir {
+			return fmt.Errorf("nix closure path %s isn't in %s", storePath, nixStoreDir)
+		}
+		if err := writeParentDirs(dest, strings.TrimPrefix(storePath, "/")); err != nil {
+			return err
+		}
+		err := filepath.WalkDir(storePath, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return fmt.Errorf("error reading nix store path %s: %w", p, err)
+			}
+			destPath := strings.TrimPrefix(p, "/")
+			if d.Type().IsRegular() {
+				return writeDestFile0(dest, filepath.Dir(destPath), BuildImageArgsFile{
+					Source: AbsPath(p),
+					Mode:   modePreserve,
+				})
+			}
+			if _, seen := dest.seen[destPath]; seen {
+				return fmt.Errorf("the layer tar file has destination file or dir %s multiple times", destPath)
+			}
+			info, err := d.Info()
+			if err != nil {
+				return fmt.Errorf("error looking up metadata for nix store path %s: %w", p, err)
+			}
+			h := &tar.Header{
+				Name:    destPath,
+				Mode:    int64(info.Mode().Perm()),
+				ModTime: dest.mtime,
+			}
+			switch {
+			case d.IsDir():
+				h.Typeflag = tar.TypeDir
+			case d.Type()&fs.ModeSymlink != 0:
+				h.Typeflag = tar.TypeSymlink
+				h.Linkname, err = os.Readlink(p)
+				if err != nil {
+					return fmt.Errorf("error reading nix store symlink %s: %w", p, err)
+				}
+			default:
+				return fmt.Errorf("nix store path %s is not a regular file, dir, or symlink", p)
+			}
+			dest.seen[destPath] = h.Typeflag
+			if err := dest.writeHeader(h); err != nil {
+				return fmt.Errorf("error writing tar header for %s: %w", destPath, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package dinkerlib
+
+import (
+	"archive/tar"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A user to add to /etc/passwd and /etc/group. Fields default to the parts of
+// the image user (`name`, `uid`, `name:group`, `uid:gid`, etc.), and must match
+// them if both are specified.
+type BuildImageArgsCreateUser struct {
+	// Defaults to `user` (`root` for uid 0)
+	Name string `json:"name"`
+	// Defaults to 1000 (0 for `root`)
+	Uid *int `json:"uid"`
+	// Primary group name, defaults to the user name
+	Group string `json:"group"`
+	// Defaults to the uid
+	Gid *int `json:"gid"`
+	// Home dir, created owned by the user. Defaults to `/home/NAME` (`/root` for
+	// uid 0).
+	Home string `json:"home"`
+	// Defaults to `/sbin/nologin`
+	Shell string `json:"shell"`
+}
+
+// The user entries with all fields filled in
+type createUser struct {
+	name  string
+	uid   int
+	group string
+	gid   int
+	home  string
+	shell string
+}
+
+// Fill in `c` from the image user spec (`user` or `user:group`, each a name or
+// id)
+func resolveCreateUser(c BuildImageArgsCreateUser, user string) (createUser, error) {
+	if user == "" {
+		return createUser{}, fmt.Errorf("creating a user requires the image user to be set")
+	}
+	userPart, groupPart, _ := strings.Cut(user, ":")
+	merge := func(field string, specified string, fromUser string) (string, error) {
+		if specified != "" && fromUser != "" && specified != fromUser {
+			return "", fmt.Errorf("create_user %s %s doesn't match %s in the image user %s", field, specified, fromUser, user)
+		}
+		return Def(specified, fromUser), nil
+	}
+	mergeId := func(field string, specified *int, fromUser string) (*int, error) {
+		if fromUser == "" {
+			return specified, nil
+		}
+		id, err := strconv.Atoi(fromUser)
+		if err != nil {
+			return specified, nil
+		}
+		if specified != nil && *specified != id {
+			return nil, fmt.Errorf("create_user %s %d doesn't match %d in the image user %s", field, *specified, id, user)
+		}
+		return &id, nil
+	}
+	isName := func(s string) bool {
+		_, err := strconv.Atoi(s)
+		return s != "" && err != nil
+	}
+	userName := ""
+	if isName(userPart) {
+		userName = userPart
+	}
+	groupName := ""
+	if isName(groupPart) {
+		groupName = groupPart
+	}
+
+	name, err := merge("name", c.Name, userName)
+	if err != nil {
+		return createUser{}, err
+	}
+	uid, err := mergeId("uid", c.Uid, userPart)
+	if err != nil {
+		return createUser{}, err
+	}
+	group, err := merge("group", c.Group, groupName)
+	if err != nil {
+		return createUser{}, err
+	}
+	gid, err := mergeId("gid", c.Gid, groupPart)
+	if err != nil {
+		return createUser{}, err
+	}
+
+	out := createUser{
+		name:  name,
+		group: group,
+		home:  c.Home,
+		shell: Def(c.Shell, "/sbin/nologin"),
+	}
+	if uid != nil {
+		out.uid = *uid
+	} else if name == "root" {
+		out.uid = 0
+	} else {
+		out.uid = 1000
+	}
+	if out.name == "" {
+		if out.uid == 0 {
+			out.name = "root"
+		} else {
+			out.name = "user"
+		}
+	}
+	out.group = Def(out.group, out.name)
+	if gid != nil {
+		out.gid = *gid
+	} else {
+		out.gid = out.uid
+	}
+	if out.home == "" {
+		if out.uid == 0 {
+			out.home = "/root"
+		} else {
+			out.home = "/home/" + out.name
+		}
+	}
+	for _, f := range []struct {
+		field string
+		value string
+	}{
+		{"name", out.name},
+		{"group", out.group},
+		{"home", out.home},
+		{"shell", out.shell},
+	} {
+		if strings.ContainsAny(f.value, ":\n") {
+			return createUser{}, fmt.Errorf("create_user %s %q can't contain colons or newlines", f.field, f.value)
+		}
+	}
+	if !strings.HasPrefix(out.home, "/") || !strings.HasPrefix(out.shell, "/") {
+		return createUser{}, fmt.Errorf("create_user home and shell must be absolute paths")
+	}
+	if out.uid < 0 || out.gid < 0 {
+		return createUser{}, fmt.Errorf("create_user uid and gid can't be negative")
+	}
+	return out, nil
+}
+
+// Write /etc/passwd and /etc/group with the user (and root, if the user isn't
+// root), and the user's home dir
+func writeCreateUser(dest *destLayer, u createUser) error {
+	passwd := "root:x:0:0:root:/root:/sbin/nologin\n"
+	group := "root:x:0:\n"
+	if u.uid == 0 {
+		passwd = ""
+	}
+	if u.gid == 0 {
+		group = ""
+	}
+	passwd += fmt.Sprintf("%s:x:%d:%d::%s:%s\n", u.name, u.uid, u.gid, u.home, u.shell)
+	group += fmt.Sprintf("%s:x:%d:\n", u.group, u.gid)
+	for _, f := range []struct {
+		path string
+		data string
+	}{
+		{"etc/passwd", passwd},
+		{"etc/group", group},
+	} {
+		if err := writeParentDirs(dest, f.path); err != nil {
+			return err
+		}
+		if _, seen := dest.seen[f.path]; seen {
+			return fmt.Errorf("the layer tar file has destination file or dir %s multiple times", f.path)
+		}
+		dest.seen[f.path] = tar.TypeReg
+		if err := writeDestData(dest, &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     f.path,
+			Mode:     0o644,
+			ModTime:  dest.mtime,
+		}, []byte(f.data)); err != nil {
+			return err
+		}
+	}
+	home := strings.Trim(u.home, "/")
+	if home == "" {
+		return nil
+	}
+	if err := writeParentDirs(dest, home); err != nil {
+		return err
+	}
+	if t, seen := dest.seen[home]; seen {
+		if t != tar.TypeDir {
+			return fmt.Errorf("the layer tar file has home dir %s, but it isn't a dir", home)
+		}
+		// Ex: added with dirs to set a different mode
+		return nil
+	}
+	dest.seen[home] = tar.TypeDir
+	if err := dest.writeHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     home,
+		Mode:     0o755,
+		Uid:      u.uid,
+		Gid:      u.gid,
+		ModTime:  dest.mtime,
+	}); err != nil {
+		return fmt.Errorf("error writing tar header for %s: %w", home, err)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package dinkerlib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The exposed port keys (ex: `80/tcp`) for a port or port range
+func (p BuildImageArgsPort) keys() ([]string, error) {
+	transport := Def(p.Transport, "tcp")
+	if p.PortRange == "" {
+		if p.Port < 1 || p.Port > 65535 {
+			return nil, fmt.Errorf("port %d is out of range", p.Port)
+		}
+		return []string{fmt.Sprintf("%d/%s", p.Port, transport)}, nil
+	}
+	if p.Port != 0 {
+		return nil, fmt.Errorf("port %d and port_range %s can't both be specified", p.Port, p.PortRange)
+	}
+	startRaw, endRaw, found := strings.Cut(p.PortRange, "-")
+	start, startErr := strconv.Atoi(strings.TrimSpace(startRaw))
+	end, endErr := strconv.Atoi(strings.TrimSpace(endRaw))
+	if !found || startErr != nil || endErr != nil || start < 1 || end > 65535 || start > end {
+		return nil, fmt.Errorf("invalid port_range %s, must be like 8000-8010", p.PortRange)
+	}
+	out := []string{}
+	for port := start; port <= end; port++ {
+		out = append(out, fmt.Sprintf("%d/%s", port, transport))
+	}
+	return out, nil
+}
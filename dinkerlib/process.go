@@ -0,0 +1,50 @@
+package dinkerlib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+)
+
+// Copy a file source to a temp file and run the process command on it (with the
+// temp file path appended), returning the processed file. The returned cleanup
+// function deletes it.
+func processSource(ctx context.Context, sources fs.FS, source AbsPath, command []string) (AbsPath, func(), error) {
+	in, err := sources.Open(sourcePath(source))
+	if err != nil {
+		return "", nil, fmt.Errorf("error opening source file %s for processing: %w", source, err)
+	}
+	defer in.Close()
+	out, err := os.CreateTemp("", ".dinker-process-*")
+	if err != nil {
+		return "", nil, fmt.Errorf("error creating temp file for processing %s: %w", source, err)
+	}
+	cleanup := func() {
+		os.Remove(out.Name())
+	}
+	_, err = io.Copy(out, ctxReader{ctx, in})
+	closeErr := out.Close()
+	if err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("error copying %s for processing: %w", source, err)
+	}
+	if closeErr != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("error closing copy of %s for processing: %w", source, closeErr)
+	}
+	// Some tools (ex: upx) refuse to process files that aren't executable
+	if err := os.Chmod(out.Name(), 0o700); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("error setting mode of copy of %s for processing: %w", source, err)
+	}
+	cmd := exec.CommandContext(ctx, command[0], append(append([]string{}, command[1:]...), out.Name())...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("error processing %s with %s: %w\n%s", source, command[0], err, output)
+	}
+	return AbsPath(out.Name()), cleanup, nil
+}
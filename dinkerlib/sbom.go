@@ -0,0 +1,134 @@
+package dinkerlib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// A regular file added to a built layer, for the SBOM
+type sbomFile struct {
+	Path   string
+	Size   int64
+	Sha1   string
+	Sha256 string
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxPackage struct {
+	SpdxId           string            `json:"SPDXID"`
+	Name             string            `json:"name"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	LicenseConcluded string            `json:"licenseConcluded"`
+	LicenseDeclared  string            `json:"licenseDeclared"`
+	CopyrightText    string            `json:"copyrightText"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxFile struct {
+	SpdxId           string         `json:"SPDXID"`
+	FileName         string         `json:"fileName"`
+	Checksums        []spdxChecksum `json:"checksums"`
+	LicenseConcluded string         `json:"licenseConcluded"`
+	CopyrightText    string         `json:"copyrightText"`
+	Comment          string         `json:"comment"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxDocument struct {
+	SpdxVersion       string           `json:"spdxVersion"`
+	DataLicense       string           `json:"dataLicense"`
+	SpdxId            string           `json:"SPDXID"`
+	Name              string           `json:"name"`
+	DocumentNamespace string           `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo `json:"creationInfo"`
+	Packages          []spdxPackage    `json:"packages,omitempty"`
+	Files             []spdxFile       `json:"files"`
+}
+
+// Write an SPDX 2.3 json document listing the added files and configured packages
+func writeSbom(path AbsPath, name string, created time.Time, files []sbomFile, packages []BuildImageArgsSbomPackage) error {
+	spdxFiles := []spdxFile{}
+	for i, f := range files {
+		spdxFiles = append(spdxFiles, spdxFile{
+			SpdxId:   fmt.Sprintf("SPDXRef-File-%d", i),
+			FileName: "./" + f.Path,
+			Checksums: []spdxChecksum{
+				{Algorithm: "SHA1", ChecksumValue: f.Sha1},
+				{Algorithm: "SHA256", ChecksumValue: f.Sha256},
+			},
+			LicenseConcluded: "NOASSERTION",
+			CopyrightText:    "NOASSERTION",
+			Comment:          fmt.Sprintf("Size: %d bytes", f.Size),
+		})
+	}
+	spdxPackages := []spdxPackage{}
+	for i, p := range packages {
+		if p.Name == "" {
+			return fmt.Errorf("sbom package %d is missing a name", i)
+		}
+		var refs []spdxExternalRef
+		if p.Purl != "" {
+			refs = append(refs, spdxExternalRef{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  p.Purl,
+			})
+		}
+		spdxPackages = append(spdxPackages, spdxPackage{
+			SpdxId:           fmt.Sprintf("SPDXRef-Package-%d", i),
+			Name:             p.Name,
+			VersionInfo:      p.Version,
+			DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  Def(p.License, "NOASSERTION"),
+			CopyrightText:    "NOASSERTION",
+			ExternalRefs:     refs,
+		})
+	}
+	if created.IsZero() {
+		created = time.Unix(0, 0)
+	}
+	// The namespace must be unique per document, base it on the contents so the
+	// output is reproducible
+	contentsHash := sha256.Sum256(canonicalJsonMarshal([]any{name, spdxFiles, spdxPackages}))
+	doc, err := json.MarshalIndent(spdxDocument{
+		SpdxVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SpdxId:            "SPDXRef-DOCUMENT",
+		Name:              name,
+		DocumentNamespace: "https://spdx.org/spdxdocs/dinker-" + hex.EncodeToString(contentsHash[:]),
+		CreationInfo: spdxCreationInfo{
+			Created:  created.UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: dinker"},
+		},
+		Packages: spdxPackages,
+		Files:    spdxFiles,
+	}, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(path.Raw(), doc, 0o644); err != nil {
+		return fmt.Errorf("error writing sbom to %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package dinkerlib
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+// Split a layer tar into part tars of about maxSize bytes, keeping each entry
+// whole. Entries larger than maxSize get a part of their own. Hardlinks are put
+// in the part with their target and opaque whiteouts in the first part with
+// anything in their dir, so those parts may be slightly larger. Returns the
+// paths of the parts (at least one), which the caller must delete.
+func splitLayerTar(ctx context.Context, r io.ReadSeeker, maxSize int64) ([]string, error) {
+	// Assign each entry a part
+	entryParts := []int{}
+	pathParts := map[string]int{}
+	// The first part with each dir or anything in it
+	dirParts := map[string]int{}
+	partCount := 1
+	var partSize int64
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading layer tar: %w", err)
+		}
+		name := path.Clean(h.Name)
+		// Header block plus data padded to the block size
+		entrySize := 512 + (h.Size+511)/512*512
+		part, found := -1, false
+		if h.Typeflag == tar.TypeLink {
+			part, found = pathParts[path.Clean(h.Linkname)]
+		} else if path.Base(name) == ".wh..wh..opq" {
+			part, found = dirParts[path.Dir(name)]
+		}
+		if !found {
+			if partSize != 0 && partSize+entrySize > maxSize {
+				partCount += 1
+				partSize = 0
+			}
+			part = partCount - 1
+			partSize += entrySize
+		}
+		entryParts = append(entryParts, part)
+		pathParts[name] = part
+		for d := name; d != "." && d != "/"; d = path.Dir(d) {
+			if prev, found := dirParts[d]; !found || part < prev {
+				dirParts[d] = part
+			}
+		}
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("error rewinding layer tar: %w", err)
+	}
+
+	// Copy the entries to their parts
+	parts := []string{}
+	files := []*os.File{}
+	tars := []*tar.Writer{}
+	fail := func(err error) ([]string, error) {
+		for _, f := range files {
+			f.Close()
+		}
+		for _, p := range parts {
+			os.Remove(p)
+		}
+		return nil, err
+	}
+	for i := 0; i < partCount; i++ {
+		f, err := os.CreateTemp("", ".dinker-layer-part-*")
+		if err != nil {
+			return fail(fmt.Errorf("error creating temp file for layer part: %w", err))
+		}
+		parts = append(parts, f.Name())
+		files = append(files, f)
+		tars = append(tars, tar.NewWriter(f))
+	}
+	tr = tar.NewReader(r)
+	for _, part := range entryParts {
+		h, err := tr.Next()
+		if err != nil {
+			return fail(fmt.Errorf("error reading layer tar: %w", err))
+		}
+		if err := tars[part].WriteHeader(h); err != nil {
+			return fail(fmt.Errorf("error writing tar header for %s to layer part: %w", h.Name, err))
+		}
+		if _, err := io.Copy(tars[part], ctxReader{ctx, tr}); err != nil {
+			return fail(fmt.Errorf("error copying %s to layer part: %w", h.Name, err))
+		}
+	}
+	for i, t := range tars {
+		if err := t.Close(); err != nil {
+			return fail(fmt.Errorf("error closing layer part tar: %w", err))
+		}
+		if err := files[i].Close(); err != nil {
+			return fail(fmt.Errorf("error closing layer part file: %w", err))
+		}
+	}
+	return parts, nil
+}
+
+// Copy all the entries of the tar at `p` to `dest`
+func copyTarEntries(ctx context.Context, p string, dest *tar.Writer) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return fmt.Errorf("error opening layer part: %w", err)
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading layer part: %w", err)
+		}
+		if err := dest.WriteHeader(h); err != nil {
+			return fmt.Errorf("error writing tar header for %s: %w", h.Name, err)
+		}
+		if _, err := io.Copy(dest, ctxReader{ctx, tr}); err != nil {
+			return fmt.Errorf("error copying %s from layer part: %w", h.Name, err)
+		}
+	}
+}
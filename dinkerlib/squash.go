@@ -0,0 +1,249 @@
+package dinkerlib
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	tarfs "github.com/nlepage/go-tarfs"
+)
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// Opens the uncompressed tar of a layer, called once for each squash pass
+type squashSource func() (io.ReadCloser, error)
+
+type multiCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (c multiCloser) Close() error {
+	var err error
+	for i := len(c.closers) - 1; i >= 0; i-- {
+		err = errors.Join(err, c.closers[i].Close())
+	}
+	return err
+}
+
+// Decompress a gzip, zstd, or uncompressed layer
+func decompressLayer(r io.ReadCloser) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(r)
+	magic, err := buffered.Peek(4)
+	if err != nil && !errors.Is(err, io.EOF) {
+		r.Close()
+		return nil, fmt.Errorf("error reading layer header: %w", err)
+	}
+	if bytes.Equal(magic, zstdMagic) {
+		zstdReader, err := zstd.NewReader(buffered)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("error opening layer as zstd: %w", err)
+		}
+		return multiCloser{zstdReader, []io.Closer{r, zstdReader.IOReadCloser()}}, nil
+	}
+	if len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzReader, err := gzip.NewReader(buffered)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("error opening layer as gzip: %w", err)
+		}
+		return multiCloser{gzReader, []io.Closer{r, gzReader}}, nil
+	}
+	return multiCloser{buffered, []io.Closer{r}}, nil
+}
+
+// A squash source for a host layer file
+func squashFileSource(p AbsPath) squashSource {
+	return func() (io.ReadCloser, error) {
+		f, err := os.Open(p.Raw())
+		if err != nil {
+			return nil, fmt.Errorf("error opening layer %s: %w", p, err)
+		}
+		return decompressLayer(f)
+	}
+}
+
+// A squash source for a layer in an oci-archive or docker-archive image
+func squashArchiveSource(p AbsPath, layerPath string) squashSource {
+	return func() (io.ReadCloser, error) {
+		f, err := os.Open(p.Raw())
+		if err != nil {
+			return nil, fmt.Errorf("error opening image %s: %w", p, err)
+		}
+		tfs, err := tarfs.New(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("error opening image %s as tar: %w", p, err)
+		}
+		layer, err := tfs.Open(layerPath)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("error opening layer %s in image %s: %w", layerPath, p, err)
+		}
+		r, err := decompressLayer(layer)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return multiCloser{r, []io.Closer{f, r}}, nil
+	}
+}
+
+// Where an entry in the squashed layer is written from
+type squashEntry struct {
+	layer int
+	index int
+	// For dirs, the header from the last layer that changed it. Dirs are written at
+	// their first position so they precede their contents.
+	dirHeader *tar.Header
+}
+
+func squashPath(p string) string {
+	return strings.Trim(path.Clean("/"+p), "/")
+}
+
+func forEachSquashEntry(ctx context.Context, sources []squashSource, cb func(layer int, index int, h *tar.Header, r io.Reader) error) error {
+	for i, source := range sources {
+		err := func() error {
+			r, err := source()
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			tr := tar.NewReader(r)
+			for j := 0; ; j++ {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				h, err := tr.Next()
+				if errors.Is(err, io.EOF) {
+					return nil
+				}
+				if err != nil {
+					return fmt.Errorf("error reading layer tar: %w", err)
+				}
+				if err := cb(i, j, h, tr); err != nil {
+					return err
+				}
+			}
+		}()
+		if err != nil {
+			return fmt.Errorf("error squashing layer %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Merge layers into a single tar, applying whiteouts. The layers are read twice,
+// first to determine which entries are visible in the final filesystem and then
+// to copy them.
+func writeSquashedTar(ctx context.Context, dest *tar.Writer, reproducible bool, sources []squashSource) error {
+	entries := map[string]*squashEntry{}
+	removeUnder := func(parent string) {
+		for k := range entries {
+			if parent == "" || strings.HasPrefix(k, parent+"/") {
+				delete(entries, k)
+			}
+		}
+	}
+	if err := forEachSquashEntry(ctx, sources, func(layer int, index int, h *tar.Header, r io.Reader) error {
+		p := squashPath(h.Name)
+		dir, name := path.Split(p)
+		dir = strings.TrimSuffix(dir, "/")
+		if name == ".wh..wh..opq" {
+			removeUnder(dir)
+			return nil
+		}
+		if strings.HasPrefix(name, ".wh.") {
+			target := path.Join(dir, strings.TrimPrefix(name, ".wh."))
+			delete(entries, target)
+			removeUnder(target)
+			return nil
+		}
+		if p == "" {
+			return nil
+		}
+		old := entries[p]
+		if h.Typeflag == tar.TypeDir {
+			if old != nil && old.dirHeader != nil {
+				old.dirHeader = h
+				return nil
+			}
+			entries[p] = &squashEntry{layer: layer, index: index, dirHeader: h}
+			return nil
+		}
+		if old != nil && old.dirHeader != nil {
+			removeUnder(p)
+		}
+		entries[p] = &squashEntry{layer: layer, index: index}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	emit := map[[2]int]string{}
+	for p, e := range entries {
+		emit[[2]int{e.layer, e.index}] = p
+	}
+	writeHeader := func(h *tar.Header) error {
+		if reproducible {
+			h.Format = tar.FormatPAX
+			h.AccessTime = time.Time{}
+			h.ChangeTime = time.Time{}
+		}
+		return dest.WriteHeader(h)
+	}
+	links := []*tar.Header{}
+	if err := forEachSquashEntry(ctx, sources, func(layer int, index int, h *tar.Header, r io.Reader) error {
+		p, found := emit[[2]int{layer, index}]
+		if !found {
+			return nil
+		}
+		e := entries[p]
+		if e.dirHeader != nil {
+			h = e.dirHeader
+			h.Name = p + "/"
+		} else {
+			h.Name = p
+		}
+		if h.Typeflag == tar.TypeLink {
+			// Written last so targets from any layer precede them
+			target := squashPath(h.Linkname)
+			targetEntry := entries[target]
+			if targetEntry == nil || targetEntry.layer > layer {
+				return fmt.Errorf("hardlink %s target %s is removed or replaced by a later layer", p, target)
+			}
+			h.Linkname = target
+			links = append(links, h)
+			return nil
+		}
+		if err := writeHeader(h); err != nil {
+			return fmt.Errorf("error writing tar header for %s: %w", p, err)
+		}
+		if h.Typeflag == tar.TypeReg {
+			if _, err := io.Copy(dest, r); err != nil {
+				return fmt.Errorf("error copying %s: %w", p, err)
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, h := range links {
+		if err := writeHeader(h); err != nil {
+			return fmt.Errorf("error writing tar header for %s: %w", h.Name, err)
+		}
+	}
+	return nil
+}
@@ -1,8 +1,13 @@
 package dinkerlib
 
 import (
+	"context"
+	"io"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 )
 
 func Def[T comparable](v T, alt T) T {
@@ -14,6 +19,27 @@ func Def[T comparable](v T, alt T) T {
 	}
 }
 
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// Stops reading with the context's error once it's cancelled
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
 type AbsPath string
 
 func MakeAbsPath(relOrAbs string) AbsPath {
@@ -24,12 +50,22 @@ func MakeAbsPath(relOrAbs string) AbsPath {
 	return AbsPath(p)
 }
 
-// During json unmarshaling, relative paths are based on the working directory of dinker
+// During json unmarshaling, relative paths are based on the working directory of
+// dinker. Urls (for file sources) are kept as-is.
 func (s *AbsPath) UnmarshalText(text []byte) error {
+	if AbsPath(text).IsUrl() {
+		*s = AbsPath(text)
+		return nil
+	}
 	*s = MakeAbsPath(string(text))
 	return nil
 }
 
+// True if this is an http or https url instead of a path
+func (p AbsPath) IsUrl() bool {
+	return strings.HasPrefix(string(p), "http://") || strings.HasPrefix(string(p), "https://")
+}
+
 func (p AbsPath) String() string {
 	return string(p)
 }
@@ -44,9 +80,19 @@ func (p AbsPath) Parent() AbsPath {
 }
 
 func (p AbsPath) Filename() string {
+	if p.IsUrl() {
+		if u, err := url.Parse(string(p)); err == nil {
+			return path.Base(u.Path)
+		}
+	}
 	return filepath.Base(string(p))
 }
 
+// True if the path contains glob metacharacters (see filepath.Match)
+func (p AbsPath) IsGlob() bool {
+	return !p.IsUrl() && strings.ContainsAny(string(p), `*?[`)
+}
+
 func (p AbsPath) Join(rel string) AbsPath {
 	if filepath.IsAbs(rel) {
 		panic("join path abs: " + rel)
@@ -0,0 +1,392 @@
+package dinkerlib
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Collects problems in the arguments without building anything
+type argsValidator struct {
+	sources fs.FS
+	errs    []error
+	// Source dirs being checked, to detect symlink loops
+	sourceDirs map[dirId]bool
+}
+
+func (v *argsValidator) fail(format string, a ...any) {
+	v.errs = append(v.errs, fmt.Errorf(format, a...))
+}
+
+func (v *argsValidator) checkHostFile(desc string, p AbsPath) {
+	if p == "" {
+		return
+	}
+	if !p.Exists() {
+		v.fail("%s %s doesn't exist", desc, p)
+	}
+}
+
+func (v *argsValidator) checkMode(desc string, destPath string, mode string) {
+	if mode == "" || mode == modePreserve {
+		return
+	}
+	if _, err := strconv.ParseInt(mode, 8, 32); err != nil {
+		v.fail("%s %s mode %s is not valid octal", desc, destPath, mode)
+	}
+}
+
+func (v *argsValidator) checkSource(desc string, destPath string, p AbsPath, wantDir bool) {
+	stat, err := fs.Stat(v.sources, sourcePath(p))
+	if err != nil {
+		v.fail("%s %s source %s can't be read: %w", desc, destPath, p, err)
+		return
+	}
+	if wantDir && !stat.IsDir() {
+		v.fail("%s %s source %s is not a dir", desc, destPath, p)
+	}
+	if !wantDir && !stat.Mode().IsRegular() {
+		v.fail("%s %s source %s is not a regular file", desc, destPath, p)
+	}
+}
+
+func (v *argsValidator) checkLibs(destPath string, p AbsPath, includeLibs bool) {
+	if !includeLibs {
+		return
+	}
+	if _, err := elfLibs(v.sources, p); err != nil {
+		v.fail("file %s include_libs: %w", destPath, err)
+	}
+}
+
+// Record a path added to a layer, reporting it if it was already added
+func (v *argsValidator) add(seen map[string]bool, destPath string) {
+	if seen[destPath] {
+		v.fail("%s is added to the same layer multiple times", destPath)
+	}
+	seen[destPath] = true
+}
+
+func joinDestPath(parentPath string, name string) string {
+	if parentPath == "" {
+		return name
+	}
+	return parentPath + "/" + name
+}
+
+func (v *argsValidator) checkFile(seen map[string]bool, parentPath string, f BuildImageArgsFile) {
+	if strings.Contains(f.Name, "/") {
+		v.fail("file %s name contains slashes; subdirs must be nested as objects", joinDestPath(parentPath, f.Name))
+		return
+	}
+	sources := 0
+	for _, s := range []string{string(f.Source), string(f.Template), f.HardLink} {
+		if s != "" {
+			sources += 1
+		}
+	}
+	if sources > 1 {
+		v.fail("file %s must have only one of source, template, or hard_link", joinDestPath(parentPath, f.Name))
+		return
+	}
+	if sources == 0 && len(f.PlatformSources) == 0 {
+		v.fail("file %s in %s has no source, template, or hard_link", f.Name, Def(parentPath, "/"))
+		return
+	}
+	if len(f.PlatformSources) != 0 && (f.Template != "" || f.HardLink != "") {
+		v.fail("file %s has platform sources so it can't have a template or hardlink target", joinDestPath(parentPath, f.Name))
+		return
+	}
+	if f.PreserveOwner && (f.HardLink != "" || f.Source.IsUrl()) {
+		v.fail("file %s preserve_owner requires a local source or template", joinDestPath(parentPath, Def(f.Name, f.Source.Filename())))
+	}
+	if len(f.Process) != 0 {
+		if f.Template != "" || f.HardLink != "" {
+			v.fail("file %s has a process command so it can't have a template or hardlink target", joinDestPath(parentPath, f.Name))
+		} else if _, err := exec.LookPath(f.Process[0]); err != nil {
+			v.fail("file %s process command %s can't be found: %w", joinDestPath(parentPath, Def(f.Name, f.Source.Filename())), f.Process[0], err)
+		}
+	}
+	if f.IncludeLibs && (f.Template != "" || f.HardLink != "") {
+		v.fail("file %s has include_libs so it can't have a template or hardlink target", joinDestPath(parentPath, f.Name))
+	}
+	if f.Sha256 != "" && !f.Source.IsUrl() {
+		v.fail("file %s has a sha256 but its source isn't a url", joinDestPath(parentPath, Def(f.Name, f.Source.Filename())))
+	}
+	if isGlobSource(v.sources, f.Source) {
+		if f.Name != "" {
+			v.fail("file with glob source %s can't have a name since it may match multiple files", f.Source)
+			return
+		}
+		matches, err := fs.Glob(v.sources, sourcePath(f.Source))
+		if err != nil {
+			v.fail("invalid glob source %s: %w", f.Source, err)
+			return
+		}
+		if len(matches) == 0 {
+			v.fail("glob source %s didn't match any files", f.Source)
+		}
+		for _, m := range matches {
+			destPath := joinDestPath(parentPath, AbsPath("/"+m).Filename())
+			v.add(seen, destPath)
+			v.checkSource("file", destPath, AbsPath("/"+m), false)
+			v.checkMode("file", destPath, f.Mode)
+			v.checkLibs(destPath, AbsPath("/"+m), f.IncludeLibs)
+		}
+		return
+	}
+	var destPath string
+	switch {
+	case f.Template != "":
+		destPath = joinDestPath(parentPath, Def(f.Name, f.Template.Filename()))
+		v.checkSource("template", destPath, f.Template, false)
+	case f.HardLink != "":
+		if f.Name == "" {
+			v.fail("hardlink to %s in %s is missing a name", f.HardLink, Def(parentPath, "/"))
+			return
+		}
+		destPath = joinDestPath(parentPath, f.Name)
+	default:
+		if f.Source.IsUrl() {
+			destPath = joinDestPath(parentPath, Def(f.Name, f.Source.Filename()))
+			if !sha256Regex.MatchString(f.Sha256) {
+				v.fail("file %s url source %s must have a sha256 (64 lowercase hex characters)", destPath, f.Source)
+			}
+			if f.Mode == modePreserve {
+				v.fail("file %s mode preserve can't be used with a url source", destPath)
+			}
+		} else if f.Source != "" {
+			destPath = joinDestPath(parentPath, Def(f.Name, f.Source.Filename()))
+			v.checkSource("file", destPath, f.Source, false)
+			v.checkLibs(destPath, f.Source, f.IncludeLibs)
+		}
+		keys := []string{}
+		for k := range f.PlatformSources {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			s := f.PlatformSources[k]
+			platformDestPath := joinDestPath(parentPath, Def(f.Name, s.Filename()))
+			if destPath == "" {
+				destPath = platformDestPath
+			}
+			if s.IsUrl() {
+				v.fail("file %s platform source %s can't be a url", platformDestPath, s)
+				continue
+			}
+			v.checkSource(fmt.Sprintf("file (platform %s)", k), platformDestPath, s, false)
+		}
+	}
+	v.add(seen, destPath)
+	v.checkMode("file", destPath, f.Mode)
+}
+
+func (v *argsValidator) checkDevice(seen map[string]bool, parentPath string, n BuildImageArgsDevice) {
+	if n.Name == "" {
+		v.fail("device in %s is missing a name", Def(parentPath, "/"))
+		return
+	}
+	destPath := joinDestPath(parentPath, n.Name)
+	if strings.Contains(n.Name, "/") {
+		v.fail("device %s name contains slashes; subdirs must be nested as objects", destPath)
+		return
+	}
+	if n.Mode == modePreserve {
+		v.fail("device %s mode preserve can only be used with files and dirs", destPath)
+	}
+	switch n.Type {
+	case "char", "block", "fifo":
+	default:
+		v.fail("device %s has unknown type %s, must be one of char, block, or fifo", destPath, n.Type)
+	}
+	v.add(seen, destPath)
+	v.checkMode("device", destPath, n.Mode)
+}
+
+// `excludes` are inherited from the parent dir, like in buildDestDir
+func (v *argsValidator) checkDir(seen map[string]bool, parentPath string, d BuildImageArgsDir, excludes *sourceExcludes) {
+	destName := d.Name
+	if d.Source != "" {
+		destName = Def(destName, d.Source.Filename())
+	}
+	destPath := joinDestPath(parentPath, destName)
+	if strings.Contains(d.Name, "/") {
+		v.fail("dir %s name contains slashes; subdirs must be nested as objects", destPath)
+		return
+	}
+	if destName == "" {
+		v.fail("dir in %s has no name or source", Def(parentPath, "/"))
+		return
+	}
+	if d.Git != nil {
+		if d.Source != "" {
+			v.fail("dir %s has both a source and a git source", destPath)
+		}
+		if _, err := checkGitSource(*d.Git); err != nil {
+			v.fail("dir %s: %w", destPath, err)
+		}
+	}
+	v.add(seen, destPath)
+	v.checkMode("dir", destPath, d.Mode)
+	if d.Mode == modePreserve && d.Source == "" && d.Git == nil {
+		v.fail("dir %s mode preserve requires a source", destPath)
+	}
+	if d.PreserveOwner && d.Source == "" && d.Git == nil {
+		v.fail("dir %s preserve_owner requires a source", destPath)
+	}
+	if len(d.Exclude) != 0 {
+		if d.Source == "" && d.Git == nil {
+			v.fail("dir %s has exclude patterns but no source", destPath)
+		} else if e, err := newSourceExcludes(d.Source, d.Exclude); err != nil {
+			v.fail("dir %s: %w", destPath, err)
+		} else {
+			excludes = e
+		}
+	}
+	if d.Source != "" {
+		v.checkSource("dir", destPath, d.Source, true)
+		if stat, err := fs.Stat(v.sources, sourcePath(d.Source)); err == nil {
+			leave, err := enterSourceDir(v.sourceDirs, stat, d.Source)
+			if err != nil {
+				v.fail("dir %s: %w", destPath, err)
+				return
+			}
+			defer leave()
+		}
+		entries, err := fs.ReadDir(v.sources, sourcePath(d.Source))
+		if err == nil {
+			for _, e := range entries {
+				source := d.Source.Join(e.Name())
+				if excludes.excluded(sourcePath(source)) {
+					continue
+				}
+				stat, err := fs.Stat(v.sources, sourcePath(source))
+				if err != nil {
+					v.fail("error looking up metadata for source dir entry %s: %w", source, err)
+					continue
+				}
+				if stat.IsDir() {
+					v.checkDir(seen, destPath, BuildImageArgsDir{Source: source}, excludes)
+				} else if stat.Mode().IsRegular() {
+					v.add(seen, joinDestPath(destPath, e.Name()))
+				} else {
+					v.fail("source dir entry %s is not a regular file or dir", source)
+				}
+			}
+		}
+	}
+	for _, d1 := range d.Dirs {
+		v.checkDir(seen, destPath, d1, nil)
+	}
+	for _, f := range d.Files {
+		v.checkFile(seen, destPath, f)
+	}
+	for _, n := range d.Devices {
+		v.checkDevice(seen, destPath, n)
+	}
+}
+
+func (v *argsValidator) checkLayer(i int, l BuildImageArgsLayer) {
+	if l.Tar != "" {
+		if len(l.Dirs) != 0 || len(l.Files) != 0 || len(l.Devices) != 0 || len(l.Remove) != 0 || len(l.Nix) != 0 || l.IncludeCaCerts {
+			v.fail("layer %d has a tar so it can't have other fields", i)
+		}
+		v.checkHostFile(fmt.Sprintf("layer %d tar", i), l.Tar)
+		return
+	}
+	seen := map[string]bool{}
+	for _, d := range l.Dirs {
+		v.checkDir(seen, "", d, nil)
+	}
+	for _, f := range l.Files {
+		v.checkFile(seen, "", f)
+	}
+	for _, n := range l.Devices {
+		v.checkDevice(seen, "", n)
+	}
+	for _, p := range l.Nix {
+		v.checkHostFile("nix store path", p)
+	}
+	if l.CaCertsSource != "" && !l.IncludeCaCerts {
+		v.fail("layer %d has ca_certs_source but include_ca_certs isn't set", i)
+	}
+	v.checkHostFile("CA certificates", l.CaCertsSource)
+	if len(l.Nix) != 0 {
+		if _, err := exec.LookPath("nix-store"); err != nil {
+			v.fail("nix store paths need nix-store, which can't be found: %w", err)
+		}
+	}
+}
+
+// Check the arguments for problems (missing sources, invalid modes, paths added
+// multiple times in a layer, etc.) without building anything, returning all the
+// problems found instead of just the first.
+func ValidateBuildImageArgs(args BuildImageArgs) []error {
+	v := argsValidator{
+		sources:    args.SourceFS,
+		sourceDirs: map[dirId]bool{},
+	}
+	if v.sources == nil {
+		v.sources = os.DirFS("/")
+	}
+	v.checkHostFile("FROM image", args.FromPath)
+	v.checkHostFile("FROM rootfs", args.FromRootfs)
+	if args.FromPath != "" && args.FromRootfs != "" {
+		v.fail("FROM image and FROM rootfs can't both be specified")
+	}
+	for _, p := range args.CopyFrom {
+		v.checkHostFile("copy_from image", p)
+	}
+	for _, p := range args.Platforms {
+		v.checkHostFile("platform FROM image", p.FromPath)
+		v.checkHostFile("platform FROM rootfs", p.FromRootfs)
+		if Def(p.FromPath, args.FromPath) != "" && Def(p.FromRootfs, args.FromRootfs) != "" && (p.FromPath != "" || p.FromRootfs != "") {
+			v.fail("platform %s/%s has both a FROM image and FROM rootfs", Def(p.Os, args.Os), Def(p.Architecture, args.Architecture))
+		}
+	}
+	if len(args.Platforms) != 0 {
+		if args.Dest != nil {
+			v.fail("writing directly to a destination isn't supported with multiple platforms")
+		}
+		if args.SbomPath != "" {
+			v.fail("sbom generation isn't supported with multiple platforms")
+		}
+	}
+	switch Def(args.Compression, "gzip") {
+	case "gzip", "estargz", "zstd:chunked", "none":
+	default:
+		v.fail("unknown layer compression %s, must be gzip, estargz, zstd:chunked, or none", args.Compression)
+	}
+	for i, l := range args.Layers {
+		v.checkLayer(i, l)
+	}
+	v.checkLayer(len(args.Layers), BuildImageArgsLayer{
+		Dirs:           args.Dirs,
+		Files:          args.Files,
+		Devices:        args.Devices,
+		Nix:            args.Nix,
+		IncludeCaCerts: args.IncludeCaCerts,
+		CaCertsSource:  args.CaCertsSource,
+	})
+	if args.CreateUser != nil {
+		if _, err := resolveCreateUser(*args.CreateUser, args.User); err != nil {
+			v.fail("%w", err)
+		}
+	}
+	for _, p := range append(append([]BuildImageArgsPort{}, args.Ports...), args.RemovePorts...) {
+		switch Def(p.Transport, "tcp") {
+		case "tcp", "udp", "sctp":
+		default:
+			v.fail("port %d has unknown transport %s, must be tcp, udp, or sctp", p.Port, p.Transport)
+		}
+		if _, err := p.keys(); err != nil {
+			v.fail("%s", err)
+		}
+	}
+	return v.errs
+}
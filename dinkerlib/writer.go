@@ -0,0 +1,116 @@
+package dinkerlib
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Writes an image as an oci-archive (a tar of an oci layout)
+type archiveDest struct {
+	tar     *tar.Writer
+	started bool
+	written map[digest.Digest]bool
+}
+
+func (d *archiveDest) writeEntry(name string, size int64, contents io.Reader) error {
+	if !d.started {
+		d.started = true
+		for _, dir := range []string{"blobs/", "blobs/" + digest.SHA256.String() + "/"} {
+			if err := d.tar.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     dir,
+				Mode:     0o755,
+				ModTime:  time.Unix(0, 0),
+			}); err != nil {
+				return fmt.Errorf("error writing archive dir %s: %w", dir, err)
+			}
+		}
+		layout := canonicalJsonMarshal(imagespec.ImageLayout{
+			Version: "1.0.0",
+		})
+		if err := d.writeFile("oci-layout", int64(len(layout)), bytes.NewReader(layout)); err != nil {
+			return err
+		}
+	}
+	return d.writeFile(name, size, contents)
+}
+
+func (d *archiveDest) writeFile(name string, size int64, contents io.Reader) error {
+	if err := d.tar.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0o644,
+		ModTime:  time.Unix(0, 0),
+	}); err != nil {
+		return fmt.Errorf("error writing archive header for %s: %w", name, err)
+	}
+	if _, err := io.CopyN(d.tar, contents, size); err != nil {
+		return fmt.Errorf("error writing archive file %s: %w", name, err)
+	}
+	return nil
+}
+
+func (d *archiveDest) PutBlob(ctx context.Context, digest digest.Digest, size int64, contents io.Reader, isConfig bool) error {
+	if d.written[digest] {
+		// Ex: the same layer added twice
+		return nil
+	}
+	d.written[digest] = true
+	return d.writeEntry(blobPath(digest), size, contents)
+}
+
+func (d *archiveDest) PutManifest(ctx context.Context, manifest []byte) error {
+	manifestDigest := digest.FromBytes(manifest)
+	if err := d.PutBlob(ctx, manifestDigest, int64(len(manifest)), bytes.NewReader(manifest), false); err != nil {
+		return err
+	}
+	index := canonicalJsonMarshal(imagespec.Index{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		Manifests: []imagespec.Descriptor{
+			{
+				MediaType: imagespec.MediaTypeImageManifest,
+				Digest:    manifestDigest,
+				Size:      int64(len(manifest)),
+			},
+		},
+	})
+	return d.writeEntry("index.json", int64(len(index)), bytes.NewReader(index))
+}
+
+// Like BuildImage, but writes the image to `w` as an oci-archive tar instead of
+// to DestDirPath. Not supported with multiple platforms. New layers are still
+// built in temp files (in the default temp dir) before being written to `w`.
+func BuildImageToWriter(args BuildImageArgs, w io.Writer) (hash string, err error) {
+	return BuildImageToWriterContext(context.Background(), args, w)
+}
+
+// Like BuildImageToWriter, but stops with the context's error if it's cancelled
+func BuildImageToWriterContext(ctx context.Context, args BuildImageArgs, w io.Writer) (hash string, err error) {
+	if args.Dest != nil {
+		return "", fmt.Errorf("Dest can't be set when building to a writer")
+	}
+	dest := &archiveDest{
+		tar:     tar.NewWriter(w),
+		written: map[digest.Digest]bool{},
+	}
+	args.Dest = dest
+	hash, err = BuildImageContext(ctx, args)
+	if err != nil {
+		return "", err
+	}
+	if err := dest.tar.Close(); err != nil {
+		return "", fmt.Errorf("error finishing archive: %w", err)
+	}
+	return hash, nil
+}
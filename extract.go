@@ -0,0 +1,258 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containers/image/v5/types"
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"golang.org/x/sys/unix"
+)
+
+// State for extracting image layers into a directory
+type extractor struct {
+	root string
+	// Ownership can only be set as root
+	chown bool
+	// Set after everything is extracted, since adding entries changes the dir mtime
+	dirTimes map[string]time.Time
+	warned   bool
+}
+
+// Resolve a path in the image to a host path, following symlinks within the root
+// so entries can't be written outside of it
+func (e *extractor) join(p string) (string, error) {
+	out, err := securejoin.SecureJoin(e.root, p)
+	if err != nil {
+		return "", fmt.Errorf("error resolving %s in extract dir: %w", p, err)
+	}
+	return out, nil
+}
+
+// Remove an existing entry unless both it and the new entry are dirs
+func (e *extractor) clear(hostPath string, dir bool) error {
+	stat, err := os.Lstat(hostPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error looking up existing %s: %w", hostPath, err)
+	}
+	if dir && stat.IsDir() {
+		return nil
+	}
+	if err := os.RemoveAll(hostPath); err != nil {
+		return fmt.Errorf("error removing existing %s: %w", hostPath, err)
+	}
+	return nil
+}
+
+func (e *extractor) removeContents(hostPath string) error {
+	entries, err := os.ReadDir(hostPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error listing %s: %w", hostPath, err)
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(hostPath, entry.Name())); err != nil {
+			return fmt.Errorf("error removing %s: %w", entry.Name(), err)
+		}
+	}
+	return nil
+}
+
+func (e *extractor) extractEntry(h *tar.Header, r io.Reader) error {
+	p := strings.Trim(path.Clean("/"+h.Name), "/")
+	if p == "" {
+		return nil
+	}
+	dir, name := path.Split(p)
+	if name == ".wh..wh..opq" {
+		hostDir, err := e.join(dir)
+		if err != nil {
+			return err
+		}
+		return e.removeContents(hostDir)
+	}
+	if strings.HasPrefix(name, ".wh.") {
+		target := strings.TrimPrefix(name, ".wh.")
+		if target == "" || target == "." || target == ".." {
+			return fmt.Errorf("invalid whiteout %s", p)
+		}
+		// Resolve the parent only, so a whiteout of a symlink removes the symlink
+		hostDir, err := e.join(dir)
+		if err != nil {
+			return err
+		}
+		hostPath := filepath.Join(hostDir, target)
+		if rel, err := filepath.Rel(e.root, hostPath); err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+			return fmt.Errorf("whiteout %s is outside the extract dir", p)
+		}
+		if err := os.RemoveAll(hostPath); err != nil {
+			return fmt.Errorf("error removing %s: %w", p, err)
+		}
+		return nil
+	}
+	hostDir, err := e.join(dir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(hostDir, 0o755); err != nil {
+		return fmt.Errorf("error creating parent dirs of %s: %w", p, err)
+	}
+	hostPath := filepath.Join(hostDir, name)
+	if err := e.clear(hostPath, h.Typeflag == tar.TypeDir); err != nil {
+		return err
+	}
+	mode := os.FileMode(h.Mode).Perm()
+	switch h.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(hostPath, 0o700); err != nil && !errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("error creating dir %s: %w", p, err)
+		}
+	case tar.TypeReg:
+		f, err := os.OpenFile(hostPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err != nil {
+			return fmt.Errorf("error creating file %s: %w", p, err)
+		}
+		_, err = io.Copy(f, r)
+		closeErr := f.Close()
+		if err != nil {
+			return fmt.Errorf("error writing file %s: %w", p, err)
+		}
+		if closeErr != nil {
+			return fmt.Errorf("error closing file %s: %w", p, closeErr)
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(h.Linkname, hostPath); err != nil {
+			return fmt.Errorf("error creating symlink %s: %w", p, err)
+		}
+	case tar.TypeLink:
+		target, err := e.join(h.Linkname)
+		if err != nil {
+			return err
+		}
+		if err := os.Link(target, hostPath); err != nil {
+			return fmt.Errorf("error creating hardlink %s to %s: %w", p, h.Linkname, err)
+		}
+		return nil
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		devMode := map[byte]uint32{
+			tar.TypeChar:  unix.S_IFCHR,
+			tar.TypeBlock: unix.S_IFBLK,
+			tar.TypeFifo:  unix.S_IFIFO,
+		}[h.Typeflag]
+		err := unix.Mknod(hostPath, devMode|uint32(mode), int(unix.Mkdev(uint32(h.Devmajor), uint32(h.Devminor))))
+		if errors.Is(err, unix.EPERM) {
+			if !e.warned {
+				log.Printf("Warning: skipping device nodes, creating them requires root")
+				e.warned = true
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error creating device %s: %w", p, err)
+		}
+	default:
+		logVerbose("Skipping %s with unsupported tar type %c", p, h.Typeflag)
+		return nil
+	}
+	if e.chown {
+		if err := os.Lchown(hostPath, h.Uid, h.Gid); err != nil {
+			return fmt.Errorf("error setting owner of %s: %w", p, err)
+		}
+	}
+	if h.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	// After chown, which clears setuid bits
+	if err := os.Chmod(hostPath, mode|tarSpecialBits(h.Mode)); err != nil {
+		return fmt.Errorf("error setting mode of %s: %w", p, err)
+	}
+	if h.Typeflag == tar.TypeDir {
+		e.dirTimes[hostPath] = h.ModTime
+	} else if err := os.Chtimes(hostPath, h.ModTime, h.ModTime); err != nil {
+		return fmt.Errorf("error setting mtime of %s: %w", p, err)
+	}
+	return nil
+}
+
+// Convert setuid/setgid/sticky from tar mode bits to go file mode bits
+func tarSpecialBits(mode int64) os.FileMode {
+	var out os.FileMode
+	if mode&0o4000 != 0 {
+		out |= os.ModeSetuid
+	}
+	if mode&0o2000 != 0 {
+		out |= os.ModeSetgid
+	}
+	if mode&0o1000 != 0 {
+		out |= os.ModeSticky
+	}
+	return out
+}
+
+// Flatten the layers of an image into a new or empty directory
+func extractCommand(ctx context.Context, sysCtx *types.SystemContext, target string, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err == nil && len(entries) != 0 {
+		return fmt.Errorf("extract dir %s must be empty or not exist", dir)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error reading extract dir %s: %w", dir, err)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("error creating extract dir %s: %w", dir, err)
+	}
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("error making extract dir %s absolute: %w", dir, err)
+	}
+	image, err := inspectImage(ctx, sysCtx, target)
+	if err != nil {
+		return err
+	}
+	e := &extractor{
+		root:     root,
+		chown:    os.Geteuid() == 0,
+		dirTimes: map[string]time.Time{},
+	}
+	if !e.chown {
+		log.Printf("Warning: not running as root, extracted files will be owned by the current user")
+	}
+	if err := readImageLayers(ctx, sysCtx, target, image.Layers, func(r io.Reader) error {
+		tr := tar.NewReader(r)
+		for {
+			h, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("error reading layer tar: %w", err)
+			}
+			if err := e.extractEntry(h, tr); err != nil {
+				return err
+			}
+		}
+	}); err != nil {
+		return err
+	}
+	for p, t := range e.dirTimes {
+		if err := os.Chtimes(p, t, t); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("error setting mtime of %s: %w", p, err)
+		}
+	}
+	logInfo("Extracted %s to %s", target, dir)
+	return nil
+}
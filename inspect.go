@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	dockerarchive "github.com/containers/image/v5/docker/archive"
+	"github.com/containers/image/v5/manifest"
+	ociarchive "github.com/containers/image/v5/oci/archive"
+	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Printed by `dinker inspect`
+type InspectResult struct {
+	Ref string `json:"ref"`
+	// Of the top level manifest, which may be an index
+	Digest    digest.Digest `json:"digest"`
+	MediaType string        `json:"media_type"`
+	// If the ref is an index, the index. The rest of the fields are for the image
+	// for the current (or `--arch`) platform.
+	Index          json.RawMessage        `json:"index,omitempty"`
+	ManifestDigest digest.Digest          `json:"manifest_digest"`
+	Manifest       json.RawMessage        `json:"manifest"`
+	Config         *imagespec.Image       `json:"config"`
+	Layers         []imagespec.Descriptor `json:"layers"`
+}
+
+// Parse a ref for inspecting, or if it's a path to a local file an oci-archive
+// or docker-archive ref
+func parseInspectRefs(target string) ([]types.ImageReference, error) {
+	if _, err := os.Stat(target); err == nil {
+		ociRef, err := ociarchive.Transport.ParseReference(target)
+		if err != nil {
+			return nil, fmt.Errorf("error making oci-archive ref for %s: %w", target, err)
+		}
+		dockerRef, err := dockerarchive.Transport.ParseReference(target)
+		if err != nil {
+			return nil, fmt.Errorf("error making docker-archive ref for %s: %w", target, err)
+		}
+		return []types.ImageReference{ociRef, dockerRef}, nil
+	}
+	ref, err := alltransports.ParseImageName(target)
+	if err != nil {
+		return nil, fmt.Errorf("%s isn't a local file or a valid image ref: %w", target, err)
+	}
+	return []types.ImageReference{ref}, nil
+}
+
+// Open the first ref that can be opened, for local files that may be either
+// archive format
+func openInspectSource(ctx context.Context, sysCtx *types.SystemContext, refs []types.ImageReference) (types.ImageReference, types.ImageSource, error) {
+	var firstErr error
+	for _, ref := range refs {
+		source, err := ref.NewImageSource(ctx, sysCtx)
+		if err == nil {
+			return ref, source, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, nil, fmt.Errorf("error opening %s: %w", refs[0].StringWithinTransport(), firstErr)
+}
+
+func inspectImage(ctx context.Context, sysCtx *types.SystemContext, target string) (InspectResult, error) {
+	refs, err := parseInspectRefs(target)
+	if err != nil {
+		return InspectResult{}, err
+	}
+	ref, source, err := openInspectSource(ctx, sysCtx, refs)
+	if err != nil {
+		return InspectResult{}, err
+	}
+	topManifest, topType, err := source.GetManifest(ctx, nil)
+	source.Close()
+	if err != nil {
+		return InspectResult{}, fmt.Errorf("error getting manifest for %s: %w", target, err)
+	}
+	topDigest, err := manifest.Digest(topManifest)
+	if err != nil {
+		return InspectResult{}, fmt.Errorf("error digesting manifest for %s: %w", target, err)
+	}
+	result := InspectResult{
+		Ref:       target,
+		Digest:    topDigest,
+		MediaType: topType,
+	}
+	if manifest.MIMETypeIsMultiImage(topType) {
+		result.Index = topManifest
+	}
+
+	// Resolves indexes to the image for the platform
+	img, err := ref.NewImage(ctx, sysCtx)
+	if err != nil {
+		return InspectResult{}, fmt.Errorf("error opening image %s: %w", target, err)
+	}
+	defer img.Close()
+	imgManifest, _, err := img.Manifest(ctx)
+	if err != nil {
+		return InspectResult{}, fmt.Errorf("error getting image manifest for %s: %w", target, err)
+	}
+	result.Manifest = imgManifest
+	result.ManifestDigest, err = manifest.Digest(imgManifest)
+	if err != nil {
+		return InspectResult{}, fmt.Errorf("error digesting image manifest for %s: %w", target, err)
+	}
+	result.Config, err = img.OCIConfig(ctx)
+	if err != nil {
+		return InspectResult{}, fmt.Errorf("error getting image config for %s: %w", target, err)
+	}
+	result.Layers = []imagespec.Descriptor{}
+	for _, l := range img.LayerInfos() {
+		result.Layers = append(result.Layers, imagespec.Descriptor{
+			MediaType: l.MediaType,
+			Digest:    l.Digest,
+			Size:      l.Size,
+		})
+	}
+	return result, nil
+}
+
+// Call `cb` with the uncompressed tar of each layer in order
+func readImageLayers(ctx context.Context, sysCtx *types.SystemContext, target string, layers []imagespec.Descriptor, cb func(r io.Reader) error) error {
+	refs, err := parseInspectRefs(target)
+	if err != nil {
+		return err
+	}
+	_, source, err := openInspectSource(ctx, sysCtx, refs)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	for _, l := range layers {
+		err := func() error {
+			blob, _, err := source.GetBlob(ctx, types.BlobInfo{Digest: l.Digest, Size: l.Size, MediaType: l.MediaType}, none.NoCache)
+			if err != nil {
+				return fmt.Errorf("error getting layer: %w", err)
+			}
+			defer blob.Close()
+			r, _, err := compression.AutoDecompress(blob)
+			if err != nil {
+				return fmt.Errorf("error decompressing layer: %w", err)
+			}
+			defer r.Close()
+			return cb(r)
+		}()
+		if err != nil {
+			return fmt.Errorf("error reading layer %s of %s: %w", l.Digest, target, err)
+		}
+	}
+	return nil
+}
+
+// Print the manifest and config of an image as json
+func inspectCommand(ctx context.Context, sysCtx *types.SystemContext, target string) error {
+	result, err := inspectImage(ctx, sysCtx, target)
+	if err != nil {
+		return err
+	}
+	out, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	if _, err := fmt.Fprintln(os.Stdout, string(out)); err != nil {
+		return fmt.Errorf("error writing inspect result: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+const (
+	// Only warnings and errors
+	logLevelQuiet logLevel = iota
+	// Progress
+	logLevelNormal
+	// Also the resolved config and digests
+	logLevelVerbose
+)
+
+var currentLogLevel = logLevelNormal
+
+// With --log-format json, log lines are written as json objects instead of text
+var jsonLogs = false
+
+type logFields map[string]any
+
+var jsonLogLock sync.Mutex
+
+func writeJsonLog(fields logFields) {
+	fields["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line, err := json.Marshal(fields)
+	if err != nil {
+		panic(err)
+	}
+	jsonLogLock.Lock()
+	defer jsonLogLock.Unlock()
+	_, _ = os.Stderr.Write(append(line, '\n'))
+}
+
+// Receives everything logged with the `log` package in json mode, which is only
+// warnings and errors
+type jsonLogWriter struct{}
+
+func (jsonLogWriter) Write(p []byte) (int, error) {
+	writeJsonLog(logFields{
+		"level":   "warning",
+		"message": strings.TrimSuffix(string(p), "\n"),
+	})
+	return len(p), nil
+}
+
+// Switch the `log` package to writing json lines
+func enableJsonLogs() {
+	jsonLogs = true
+	log.SetFlags(0)
+	log.SetOutput(jsonLogWriter{})
+}
+
+func logLevelMessage(level string, format string, v ...any) {
+	if !jsonLogs {
+		log.Printf(format, v...)
+		return
+	}
+	writeJsonLog(logFields{
+		"level":   level,
+		"message": fmt.Sprintf(format, v...),
+	})
+}
+
+// Log progress, unless --quiet
+func logInfo(format string, v ...any) {
+	if currentLogLevel >= logLevelNormal {
+		logLevelMessage("info", format, v...)
+	}
+}
+
+// Log details, with --verbose or --debug
+func logVerbose(format string, v ...any) {
+	if currentLogLevel >= logLevelVerbose {
+		logLevelMessage("verbose", format, v...)
+	}
+}
+
+// Log the start or end of a build or push phase (unless --quiet). In json mode
+// the fields are included in the log line so they can be used without parsing
+// the message.
+func logEvent(event string, fields logFields, format string, v ...any) {
+	if currentLogLevel < logLevelNormal {
+		return
+	}
+	if !jsonLogs {
+		log.Printf(format, v...)
+		return
+	}
+	fields["event"] = event
+	fields["level"] = "info"
+	fields["message"] = fmt.Sprintf(format, v...)
+	writeJsonLog(fields)
+}
+
+// Log a fatal error
+func logFatal(err error) {
+	if !jsonLogs {
+		log.Fatalf("Exiting with fatal error: %s", err)
+	}
+	writeJsonLog(logFields{
+		"event":   "error",
+		"level":   "error",
+		"message": fmt.Sprintf("Exiting with fatal error: %s", err),
+		"error":   err.Error(),
+	})
+	os.Exit(1)
+}
+
+// Replace the values of secret fields (passwords, tokens, passphrases) in
+// decoded json
+func redactSecrets(value any) any {
+	switch value := value.(type) {
+	case map[string]any:
+		out := map[string]any{}
+		for k, v := range value {
+			lower := strings.ToLower(k)
+			if s, ok := v.(string); ok && s != "" && (strings.Contains(lower, "password") || strings.Contains(lower, "token") || strings.Contains(lower, "passphrase")) {
+				out[k] = "<redacted>"
+				continue
+			}
+			out[k] = redactSecrets(v)
+		}
+		return out
+	case []any:
+		out := []any{}
+		for _, v := range value {
+			out = append(out, redactSecrets(v))
+		}
+		return out
+	default:
+		return value
+	}
+}
+
+// Log the config after applying defaults and overrides, with --verbose
+func logResolvedConfig(config Config) {
+	if currentLogLevel < logLevelVerbose {
+		return
+	}
+	configJson, err := json.Marshal(config)
+	if err != nil {
+		panic(err)
+	}
+	var raw any
+	if err := json.Unmarshal(configJson, &raw); err != nil {
+		panic(err)
+	}
+	if jsonLogs {
+		writeJsonLog(logFields{
+			"event":  "config",
+			"level":  "verbose",
+			"config": redactSecrets(raw),
+		})
+		return
+	}
+	redactedJson, err := json.MarshalIndent(redactSecrets(raw), "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	log.Printf("Resolved config:\n%s", redactedJson)
+}
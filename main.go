@@ -3,21 +3,36 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/andrewbaxter/dinker/dinkerlib"
 	imagecopy "github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
 	"github.com/containers/image/v5/manifest"
 	"github.com/containers/image/v5/oci/archive"
 	ocidir "github.com/containers/image/v5/oci/layout"
+	"github.com/containers/image/v5/pkg/blobinfocache"
 	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/signature/signer"
 	"github.com/containers/image/v5/transports/alltransports"
 	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
 )
 
 type RegistryCreds struct {
@@ -26,67 +41,858 @@ type RegistryCreds struct {
 }
 
 type ConfigDest struct {
+	Ref            string            `json:"ref"`
+	Tags           []string          `json:"tags"`
+	User           string            `json:"user"`
+	Password       string            `json:"password"`
+	Token          string            `json:"token"`
+	IdentityToken  string            `json:"identity_token"`
+	Auth           string            `json:"auth"`
+	Http           bool              `json:"http"`
+	Host           string            `json:"host"`
+	Namespace      string            `json:"namespace"`
+	CaCert         dinkerlib.AbsPath `json:"ca_cert"`
+	ClientCert     dinkerlib.AbsPath `json:"client_cert"`
+	ClientKey      dinkerlib.AbsPath `json:"client_key"`
+	SkipExisting   bool              `json:"skip_existing"`
+	Sign           *ConfigSign       `json:"sign"`
+	Retries        int               `json:"retries"`
+	ChunkSize      int64             `json:"chunk_size"`
+	RetryDelay     string            `json:"retry_delay"`
+	ManifestFormat string            `json:"manifest_format"`
+	BypassProxy    bool              `json:"bypass_proxy"`
+}
+
+type ConfigMirror struct {
+	Registry string `json:"registry"`
+	Mirror   string `json:"mirror"`
+	Http     bool   `json:"http"`
+}
+
+// An existing image to set as the subject of the built image
+type ConfigSubject struct {
 	Ref      string `json:"ref"`
+	Http     bool   `json:"http"`
 	User     string `json:"user"`
 	Password string `json:"password"`
-	Http     bool   `json:"http"`
-	Host     string `json:"host"`
+}
+
+// A file to attach to pushed images as an artifact
+type ConfigArtifact struct {
+	Path dinkerlib.AbsPath `json:"path"`
+	Type string            `json:"type"`
+}
+
+// Generate an SBOM of added files, attached to images pushed to registries
+type ConfigSbom struct {
+	// Defaults to the first dest ref
+	Name     string                                `json:"name"`
+	Packages []dinkerlib.BuildImageArgsSbomPackage `json:"packages"`
+	// Optional, also write the SBOM here
+	Path dinkerlib.AbsPath `json:"path"`
 }
 
 type Config struct {
-	From         dinkerlib.AbsPath              `json:"from"`
-	FromPull     string                         `json:"from_pull"`
-	FromUser     string                         `json:"from_user"`
-	FromPassword string                         `json:"from_password"`
-	FromHttp     bool                           `json:"from_http"`
-	FromHost     string                         `json:"from_host"`
-	Dests        []ConfigDest                   `json:"dests"`
-	Architecture string                         `json:"arch"`
-	Os           string                         `json:"os"`
-	Files        []dinkerlib.BuildImageArgsFile `json:"files"`
-	AddEnv       map[string]string              `json:"add_env"`
-	ClearEnv     bool                           `json:"clear_env"`
-	WorkingDir   string                         `json:"working_dir"`
-	User         string                         `json:"user"`
-	Entrypoint   []string                       `json:"entrypoint"`
-	Cmd          []string                       `json:"cmd"`
-	Ports        []dinkerlib.BuildImageArgsPort `json:"ports"`
-	Labels       map[string]string              `json:"labels"`
-	StopSignal   string                         `json:"stop_signal"`
+	From                dinkerlib.AbsPath                   `json:"from"`
+	FromPull            string                              `json:"from_pull"`
+	FromRootfs          dinkerlib.AbsPath                   `json:"from_rootfs"`
+	FromRefresh         string                              `json:"from_refresh"`
+	FromDaemon          string                              `json:"from_daemon"`
+	FromUser            string                              `json:"from_user"`
+	FromPassword        string                              `json:"from_password"`
+	FromToken           string                              `json:"from_token"`
+	FromIdentityToken   string                              `json:"from_identity_token"`
+	FromAuth            string                              `json:"from_auth"`
+	FromHttp            bool                                `json:"from_http"`
+	FromHost            string                              `json:"from_host"`
+	FromCaCert          dinkerlib.AbsPath                   `json:"from_ca_cert"`
+	FromClientCert      dinkerlib.AbsPath                   `json:"from_client_cert"`
+	FromClientKey       dinkerlib.AbsPath                   `json:"from_client_key"`
+	AuthFile            dinkerlib.AbsPath                   `json:"auth_file"`
+	Mirrors             []ConfigMirror                      `json:"mirrors"`
+	Proxy               string                              `json:"proxy"`
+	NoProxy             []string                            `json:"no_proxy"`
+	CopyFrom            []dinkerlib.AbsPath                 `json:"copy_from"`
+	CopyFromPull        []string                            `json:"copy_from_pull"`
+	Dests               []ConfigDest                        `json:"dests"`
+	Architecture        string                              `json:"arch"`
+	Os                  string                              `json:"os"`
+	Variant             string                              `json:"variant"`
+	OsVersion           string                              `json:"os_version"`
+	OsFeatures          []string                            `json:"os_features"`
+	Platforms           []dinkerlib.BuildImageArgsPlatform  `json:"platforms"`
+	Files               []dinkerlib.BuildImageArgsFile      `json:"files"`
+	Dirs                []dinkerlib.BuildImageArgsDir       `json:"dirs"`
+	Devices             []dinkerlib.BuildImageArgsDevice    `json:"devices"`
+	Remove              []string                            `json:"remove"`
+	Nix                 []dinkerlib.AbsPath                 `json:"nix"`
+	IncludeCaCerts      bool                                `json:"include_ca_certs"`
+	CaCertsSource       dinkerlib.AbsPath                   `json:"ca_certs_source"`
+	Layers              []dinkerlib.BuildImageArgsLayer     `json:"layers"`
+	AddEnv              map[string]string                   `json:"add_env"`
+	ClearEnv            bool                                `json:"clear_env"`
+	RemoveEnv           []string                            `json:"remove_env"`
+	WorkingDir          string                              `json:"working_dir"`
+	ClearWorkingDir     bool                                `json:"clear_working_dir"`
+	User                string                              `json:"user"`
+	ClearUser           bool                                `json:"clear_user"`
+	CreateUser          *dinkerlib.BuildImageArgsCreateUser `json:"create_user"`
+	Entrypoint          []string                            `json:"entrypoint"`
+	ClearEntrypoint     bool                                `json:"clear_entrypoint"`
+	Cmd                 []string                            `json:"cmd"`
+	ClearCmd            bool                                `json:"clear_cmd"`
+	Shell               []string                            `json:"shell"`
+	Ports               []dinkerlib.BuildImageArgsPort      `json:"ports"`
+	ClearPorts          bool                                `json:"clear_ports"`
+	RemovePorts         []dinkerlib.BuildImageArgsPort      `json:"remove_ports"`
+	Volumes             []string                            `json:"volumes"`
+	ClearVolumes        bool                                `json:"clear_volumes"`
+	RemoveVolumes       []string                            `json:"remove_volumes"`
+	Labels              map[string]string                   `json:"labels"`
+	ClearLabels         bool                                `json:"clear_labels"`
+	StandardAnnotations *ConfigStandardAnnotations          `json:"standard_annotations"`
+	Author              string                              `json:"author"`
+	StopSignal          string                              `json:"stop_signal"`
+	ClearStopSignal     bool                                `json:"clear_stop_signal"`
+	Created             time.Time                           `json:"created"`
+	Reproducible        bool                                `json:"reproducible"`
+	Squash              bool                                `json:"squash"`
+	MaxLayerSize        int64                               `json:"max_layer_size"`
+	MaxImageSize        int64                               `json:"max_image_size"`
+	Compression         string                              `json:"compression"`
+	CompressionThreads  int                                 `json:"compression_threads"`
+	CacheDir            dinkerlib.AbsPath                   `json:"cache_dir"`
+	OutputDir           dinkerlib.AbsPath                   `json:"output_dir"`
+	SkipUnchanged       bool                                `json:"skip_unchanged"`
+	Stream              bool                                `json:"stream"`
+	MaxTransfers        int                                 `json:"max_transfers"`
+	Sbom                *ConfigSbom                         `json:"sbom"`
+	Subject             *ConfigSubject                      `json:"subject"`
+	Artifacts           []ConfigArtifact                    `json:"artifacts"`
+	Images              []Config                            `json:"images"`
+}
+
+const sbomMediaType = "application/spdx+json"
+
+const (
+	manifestFormatOci    = "oci"
+	manifestFormatDocker = "docker"
+)
+
+// Stored in the output dir to detect unchanged builds
+type BuildState struct {
+	Inputs string `json:"inputs"`
+	Hash   string `json:"hash"`
+}
+
+var refEnvRegex = regexp.MustCompile(`\{env:([^}]+)\}`)
+
+type ResultDest struct {
+	Ref            string        `json:"ref"`
+	ManifestDigest digest.Digest `json:"manifest_digest,omitempty"`
+	Skipped        bool          `json:"skipped,omitempty"`
+	// Blobs uploaded and already present, if pushed
+	Stats *PushStats `json:"stats,omitempty"`
+}
+
+// Summary of the build, written with --result-file
+type Result struct {
+	Hash           string        `json:"hash"`
+	ManifestDigest digest.Digest `json:"manifest_digest"`
+	// For single platform images
+	ConfigDigest digest.Digest          `json:"config_digest,omitempty"`
+	Layers       []imagespec.Descriptor `json:"layers,omitempty"`
+	Size         *ImageSize             `json:"size,omitempty"`
+	// For multi-platform images
+	Manifests []imagespec.Descriptor `json:"manifests,omitempty"`
+	// In the same order as manifests
+	Sizes []ImageSize  `json:"sizes,omitempty"`
+	Dests []ResultDest `json:"dests"`
+}
+
+// Dest ref variables based on the build time
+func timeRefVars(created time.Time) map[string]string {
+	refTime := created
+	if refTime.IsZero() {
+		refTime = time.Now()
+	}
+	refTime = refTime.UTC()
+	return map[string]string{
+		"date":  refTime.Format("20060102"),
+		"epoch": strconv.FormatInt(refTime.Unix(), 10),
+	}
+}
+
+// Any variable, including `{env:VAR}`
+var refPlaceholderRegex = regexp.MustCompile(`\{[^}]*\}`)
+
+// The refs to push to for a dest, one per tag or just the ref if there are no
+// tags
+func destRefs(dest ConfigDest) []string {
+	if len(dest.Tags) == 0 {
+		return []string{dest.Ref}
+	}
+	out := []string{}
+	for _, tag := range dest.Tags {
+		out = append(out, dest.Ref+":"+tag)
+	}
+	return out
+}
+
+// Check that tags can be appended to a dest ref, which must not have a tag or
+// digest already
+func checkTaggableRef(ref string) error {
+	name := ""
+	for _, prefix := range []string{"docker://", "docker-daemon:"} {
+		if rest, found := strings.CutPrefix(ref, prefix); found {
+			name = rest
+		}
+	}
+	if name == "" {
+		return nil
+	}
+	// Variables are only known when pushing
+	named, err := reference.ParseNormalizedNamed(refPlaceholderRegex.ReplaceAllString(name, "0"))
+	if err != nil {
+		return fmt.Errorf("ref %s is invalid: %w", ref, err)
+	}
+	if _, ok := named.(reference.Tagged); ok {
+		return fmt.Errorf("ref %s already has a tag, so tags (from `tags` or `--tag`) can't be added to it", ref)
+	}
+	if _, ok := named.(reference.Digested); ok {
+		return fmt.Errorf("ref %s has a digest, so tags (from `tags` or `--tag`) can't be added to it", ref)
+	}
+	return nil
+}
+
+// Replace `{VAR}` and `{env:VAR}` in a dest ref
+func expandDestRef(ref string, vars map[string]string) (string, error) {
+	out := ref
+	for k, v := range vars {
+		out = strings.ReplaceAll(out, fmt.Sprintf("{%s}", k), v)
+	}
+	var envErr error
+	out = refEnvRegex.ReplaceAllStringFunc(out, func(m string) string {
+		k := refEnvRegex.FindStringSubmatch(m)[1]
+		v, found := os.LookupEnv(k)
+		if !found {
+			envErr = fmt.Errorf("dest ref %s uses environment variable %s which isn't set", ref, k)
+		}
+		return v
+	})
+	if envErr != nil {
+		return "", envErr
+	}
+	return out, nil
+}
+
+// Write a registries.conf with the mirrors to a temp file, returning the path
+func writeMirrorsConf(mirrors []ConfigMirror) (string, error) {
+	registries := []string{}
+	registryMirrors := map[string][]ConfigMirror{}
+	for _, m := range mirrors {
+		if m.Registry == "" || m.Mirror == "" {
+			return "", fmt.Errorf("mirror is missing registry or mirror")
+		}
+		if _, seen := registryMirrors[m.Registry]; !seen {
+			registries = append(registries, m.Registry)
+		}
+		registryMirrors[m.Registry] = append(registryMirrors[m.Registry], m)
+	}
+	conf := strings.Builder{}
+	for _, r := range registries {
+		fmt.Fprintf(&conf, "[[registry]]\nprefix = %s\nlocation = %s\n", strconv.Quote(r), strconv.Quote(r))
+		for _, m := range registryMirrors[r] {
+			fmt.Fprintf(&conf, "[[registry.mirror]]\nlocation = %s\ninsecure = %t\n", strconv.Quote(m.Mirror), m.Http)
+		}
+	}
+	f, err := os.CreateTemp("", ".dinker-registries-*.conf")
+	if err != nil {
+		return "", fmt.Errorf("unable to create temp registries config for mirrors: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(conf.String()); err != nil {
+		return "", fmt.Errorf("error writing temp registries config for mirrors: %w", err)
+	}
+	return f.Name(), nil
+}
+
+// Check for problems in the config that don't need any files or registries, in
+// which fields are missing or can't be used together
+func checkConfig(config Config) []error {
+	errs := []error{}
+	if config.FromDaemon != "" && config.FromPull != "" {
+		errs = append(errs, fmt.Errorf("from_daemon and from_pull can't both be specified"))
+	}
+	if config.From == "" && config.FromDaemon == "" && config.FromRootfs == "" && config.Os == "" && config.Architecture == "" && len(config.Platforms) == 0 {
+		errs = append(errs, fmt.Errorf("missing FROM ref in config"))
+	}
+	if config.FromRootfs != "" {
+		if config.From != "" || config.FromDaemon != "" {
+			errs = append(errs, fmt.Errorf("from_rootfs can't be used with from or from_daemon"))
+		}
+		if len(config.Platforms) == 0 && (config.Os == "" || config.Architecture == "") {
+			errs = append(errs, fmt.Errorf("from_rootfs requires os and arch"))
+		}
+	}
+	if len(config.Files) == 0 && len(config.Dirs) == 0 && len(config.Devices) == 0 && len(config.Remove) == 0 && len(config.Nix) == 0 && !config.IncludeCaCerts && config.CreateUser == nil && len(config.Layers) == 0 {
+		errs = append(errs, fmt.Errorf("missing files to add in config"))
+	}
+	if config.CreateUser != nil {
+		hasFrom := config.From != "" || config.FromDaemon != "" || config.FromRootfs != ""
+		for _, p := range config.Platforms {
+			if p.FromPath != "" || p.FromRootfs != "" {
+				hasFrom = true
+			}
+		}
+		if hasFrom {
+			errs = append(errs, fmt.Errorf("create_user can only be used without a FROM image, since it would replace the FROM image's /etc/passwd and /etc/group"))
+		}
+	}
+	if len(config.Dests) == 0 && config.OutputDir == "" {
+		errs = append(errs, fmt.Errorf("missing dests or output_dir in config"))
+	}
+	for i, dest := range config.Dests {
+		if dest.Ref == "" {
+			errs = append(errs, fmt.Errorf("dest %d is missing a ref", i))
+		}
+		if len(dest.Tags) != 0 {
+			if err := checkTaggableRef(dest.Ref); err != nil {
+				errs = append(errs, fmt.Errorf("dest %d %w", i, err))
+			}
+		}
+		if _, ok := dockerRefHost(dest.Ref); dest.BypassProxy && !ok {
+			errs = append(errs, fmt.Errorf("dest %d bypass_proxy can only be used with docker:// dests", i))
+		}
+		switch dest.ManifestFormat {
+		case "", manifestFormatOci:
+		case manifestFormatDocker:
+			if len(config.Platforms) != 0 || config.Subject != nil || config.Stream {
+				errs = append(errs, fmt.Errorf("dest %d manifest_format docker can't be used with platforms, subject, or stream", i))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("dest %d has unknown manifest_format %s, must be oci or docker", i, dest.ManifestFormat))
+		}
+	}
+	if config.AuthFile != "" && !config.AuthFile.Exists() {
+		errs = append(errs, fmt.Errorf("auth_file %s doesn't exist", config.AuthFile))
+	}
+	if config.MaxLayerSize < 0 {
+		errs = append(errs, fmt.Errorf("max_layer_size can't be negative"))
+	}
+	if config.MaxImageSize < 0 {
+		errs = append(errs, fmt.Errorf("max_image_size can't be negative"))
+	}
+	if config.MaxLayerSize != 0 && config.Squash {
+		errs = append(errs, fmt.Errorf("max_layer_size can't be used with squash"))
+	}
+	if config.MaxTransfers < 0 {
+		errs = append(errs, fmt.Errorf("max_transfers can't be negative"))
+	}
+	if config.SkipUnchanged && config.OutputDir == "" {
+		errs = append(errs, fmt.Errorf("skip_unchanged requires output_dir, to keep the previous image"))
+	}
+	if config.Stream {
+		if len(config.Dests) != 1 || len(config.Dests[0].Tags) != 0 {
+			errs = append(errs, fmt.Errorf("stream requires exactly one dest, without tags"))
+		} else {
+			dest := config.Dests[0]
+			if len(config.Platforms) != 0 || config.OutputDir != "" || config.Sbom != nil || len(config.Artifacts) != 0 || dest.Sign != nil || dest.SkipExisting || dest.Retries != 0 || dest.ChunkSize != 0 || config.MaxImageSize != 0 {
+				errs = append(errs, fmt.Errorf("stream can't be used with platforms, output_dir, sbom, artifacts, max_image_size, or dest sign, skip_existing, retries, or chunk_size"))
+			}
+		}
+	}
+	if len(config.CopyFromPull) > len(config.CopyFrom) {
+		errs = append(errs, fmt.Errorf("copy_from_pull has more refs than copy_from has paths"))
+	}
+	for i, a := range config.Artifacts {
+		if a.Path == "" || a.Type == "" {
+			errs = append(errs, fmt.Errorf("artifact %d is missing a path or type", i))
+		}
+	}
+
+	// Refs, with placeholders for variables that are only known after building
+	refVars := timeRefVars(config.Created)
+	refVars["hash"] = strings.Repeat("0", 64)
+	refVars["short_hash"] = strings.Repeat("0", 8)
+	if len(config.Platforms) == 0 {
+		// Not known for multi-platform images
+		refVars["arch"] = "amd64"
+		refVars["os"] = "linux"
+	}
+	checkRef := func(desc string, ref string) {
+		if ref == "" {
+			return
+		}
+		if _, err := alltransports.ParseImageName(ref); err != nil {
+			errs = append(errs, fmt.Errorf("%s %s is invalid: %w", desc, ref, err))
+		}
+	}
+	for i, dest := range config.Dests {
+		if len(dest.Tags) != 0 && checkTaggableRef(dest.Ref) != nil {
+			// Reported above
+			continue
+		}
+		for _, ref := range destRefs(dest) {
+			expanded, err := expandDestRef(ref, refVars)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if v := refVarRegex.FindString(expanded); v == "{arch}" || v == "{os}" {
+				errs = append(errs, fmt.Errorf("dest %d ref %s uses %s, which can't be used with platforms", i, ref, v))
+				continue
+			} else if v != "" {
+				errs = append(errs, fmt.Errorf("dest %d ref %s uses unknown variable %s", i, ref, v))
+				continue
+			}
+			checkRef(fmt.Sprintf("dest %d ref", i), expanded)
+		}
+	}
+	checkRef("from_pull", config.FromPull)
+	for i, ref := range config.CopyFromPull {
+		checkRef(fmt.Sprintf("copy_from_pull %d", i), ref)
+	}
+	if config.Subject != nil {
+		checkRef("subject ref", config.Subject.Ref)
+	}
+	for i, m := range config.Mirrors {
+		if m.Registry == "" || m.Mirror == "" {
+			errs = append(errs, fmt.Errorf("mirror %d is missing registry or mirror", i))
+		}
+	}
+	return errs
+}
+
+// Check that the local files the config refers to (other than build inputs)
+// exist
+func checkConfigFiles(config Config) []error {
+	errs := []error{}
+	checkFile := func(desc string, p dinkerlib.AbsPath) {
+		if p != "" && !p.Exists() {
+			errs = append(errs, fmt.Errorf("%s %s doesn't exist", desc, p))
+		}
+	}
+	checkFile("from_ca_cert", config.FromCaCert)
+	checkFile("from_client_cert", config.FromClientCert)
+	checkFile("from_client_key", config.FromClientKey)
+	for i, dest := range config.Dests {
+		checkFile(fmt.Sprintf("dest %d ca_cert", i), dest.CaCert)
+		checkFile(fmt.Sprintf("dest %d client_cert", i), dest.ClientCert)
+		checkFile(fmt.Sprintf("dest %d client_key", i), dest.ClientKey)
+		if dest.Sign != nil {
+			checkFile(fmt.Sprintf("dest %d sign key", i), dest.Sign.Key)
+		}
+	}
+	for i, a := range config.Artifacts {
+		checkFile(fmt.Sprintf("artifact %d", i), a.Path)
+	}
+	return errs
+}
+
+// Parse the config json into one config per image. If there's an `images` array,
+// each image's fields replace the top level fields of the same name.
+func parseConfigs(configJson []byte) (configs []Config, multiImage bool, err error) {
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(configJson, &top); err != nil {
+		return nil, false, err
+	}
+	imagesJson, multiImage := top["images"]
+	if !multiImage {
+		var config Config
+		if err := json.Unmarshal(configJson, &config); err != nil {
+			return nil, false, err
+		}
+		return []Config{config}, false, nil
+	}
+	delete(top, "images")
+	var images []map[string]json.RawMessage
+	if err := json.Unmarshal(imagesJson, &images); err != nil {
+		return nil, false, fmt.Errorf("error parsing images: %w", err)
+	}
+	if len(images) == 0 {
+		return nil, false, fmt.Errorf("images is empty")
+	}
+	for i, image := range images {
+		if _, found := image["images"]; found {
+			return nil, false, fmt.Errorf("image %d has images, but images can't be nested", i)
+		}
+		merged := map[string]json.RawMessage{}
+		for k, v := range top {
+			merged[k] = v
+		}
+		for k, v := range image {
+			merged[k] = v
+		}
+		mergedJson, err := json.Marshal(merged)
+		if err != nil {
+			panic(err)
+		}
+		var config Config
+		if err := json.Unmarshal(mergedJson, &config); err != nil {
+			return nil, false, fmt.Errorf("error parsing image %d: %w", i, err)
+		}
+		configs = append(configs, config)
+	}
+	return configs, true, nil
+}
+
+// Read the config file, or stdin if the path is `-`
+func readConfig(configPath string) ([]byte, error) {
+	if configPath == "-" {
+		out, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("error reading config from stdin: %w", err)
+		}
+		return out, nil
+	}
+	out, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config at %s: %w", configPath, err)
+	}
+	return out, nil
+}
+
+// A flag that can be specified multiple times
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
 }
 
 func main0() error {
-	if len(os.Args) != 2 {
+	resultFile := flag.String("result-file", "", "Write a json summary of the build and pushed images to this path, or - for stdout")
+	dryRun := flag.Bool("dry-run", false, "Build the image and show where it would be pushed, without pushing")
+	var flagDests, flagTags, flagLabels stringsFlag
+	flag.Var(&flagDests, "dest", "Add a dest with this ref, in addition to dests in the config (repeatable)")
+	flag.Var(&flagTags, "tag", "Add a tag to every dest (repeatable)")
+	flag.Var(&flagLabels, "label", "Set a label, as KEY=VALUE, overriding the config (repeatable)")
+	flagArch := flag.String("arch", "", "Override arch in the config")
+	flagFromPull := flag.String("from-pull", "", "Override from_pull in the config")
+	flagAuthFileRaw := flag.String("authfile", "", "Read registry credentials from this podman/skopeo style auth file, overriding auth_file in the config")
+	watch := flag.Bool("watch", false, "Rebuild and push whenever the config or files it references change")
+	watchInterval := flag.Duration("watch-interval", time.Second, "How often to check for changes with --watch")
+	quiet := flag.Bool("quiet", false, "Only log warnings and errors")
+	verbose := flag.Bool("verbose", false, "Also log the resolved config and digests")
+	debug := flag.Bool("debug", false, "Like --verbose, and also log registry and image copy debug messages")
+	flagHttp := flag.Bool("http", false, "For inspect, diff, and extract, the registry is over http (disable tls validation)")
+	diffFilesFlag := flag.Bool("files", false, "For diff, also compare the files in the images (downloads all layers)")
+	logFormat := flag.String("log-format", "text", "Log format, text or json (one object per line)")
+	flag.Parse()
+	var flagAuthFile dinkerlib.AbsPath
+	if *flagAuthFileRaw != "" {
+		flagAuthFile = dinkerlib.MakeAbsPath(*flagAuthFileRaw)
+	}
+	switch *logFormat {
+	case "text":
+	case "json":
+		enableJsonLogs()
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("invalid --log-format %s, must be text or json", *logFormat)
+	}
+	switch {
+	case *quiet && (*verbose || *debug):
+		return fmt.Errorf("--quiet can't be used with --verbose or --debug")
+	case *quiet:
+		currentLogLevel = logLevelQuiet
+	case *verbose || *debug:
+		currentLogLevel = logLevelVerbose
+	}
+	if *debug {
+		// Used by containers/image
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+	if flag.NArg() == 1 && flag.Arg(0) == "schema" {
+		return schemaCommand()
+	}
+	if flag.NArg() == 1 && flag.Arg(0) == "version" {
+		return versionCommand()
+	}
+	if flag.NArg() == 2 && flag.Arg(0) == "inspect" {
+		sysCtx, cleanup, err := registryArgs{Http: *flagHttp, AuthFile: flagAuthFile}.systemContext()
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		sysCtx.ArchitectureChoice = *flagArch
+		return inspectCommand(context.Background(), sysCtx, flag.Arg(1))
+	}
+	if flag.NArg() == 3 && flag.Arg(0) == "diff" {
+		sysCtx, cleanup, err := registryArgs{Http: *flagHttp, AuthFile: flagAuthFile}.systemContext()
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		sysCtx.ArchitectureChoice = *flagArch
+		return diffCommand(context.Background(), sysCtx, flag.Arg(1), flag.Arg(2), *diffFilesFlag)
+	}
+	if flag.NArg() == 3 && flag.Arg(0) == "extract" {
+		sysCtx, cleanup, err := registryArgs{Http: *flagHttp, AuthFile: flagAuthFile}.systemContext()
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		sysCtx.ArchitectureChoice = *flagArch
+		return extractCommand(context.Background(), sysCtx, flag.Arg(1), flag.Arg(2))
+	}
+	validate := flag.NArg() == 2 && flag.Arg(0) == "validate"
+	if flag.NArg() != 1 && !validate {
 		return fmt.Errorf("must have one argument: path to config json file")
 	}
-	var args0 []byte
-	if os.Args[1] == "-" {
-		var err error
-		args0, err = io.ReadAll(os.Stdin)
+	// Stop building on interrupt, so temp files are cleaned up
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	configPath := flag.Arg(flag.NArg() - 1)
+	if *watch && (validate || configPath == "-") {
+		return fmt.Errorf("--watch can't be used with validate or a config from stdin")
+	}
+	loadConfigs := func() (configJson []byte, configs []Config, multiImage bool, err error) {
+		configJson, err = readConfig(configPath)
 		if err != nil {
-			return fmt.Errorf("error reading config from stdin: %w", err)
+			return nil, nil, false, err
 		}
-	} else {
-		var err error
-		args0, err = os.ReadFile(os.Args[1])
+		configs, multiImage, err = parseConfigs(configJson)
+		if err != nil {
+			return nil, nil, false, fmt.Errorf("error parsing config json at %s: %w", configPath, err)
+		}
+
+		// Apply command line overrides
+		if len(flagDests) != 0 && len(configs) > 1 {
+			return nil, nil, false, fmt.Errorf("--dest can't be used with multiple images, since every image would be pushed to the same ref")
+		}
+		for c := range configs {
+			config := &configs[c]
+			for _, ref := range flagDests {
+				config.Dests = append(config.Dests, ConfigDest{Ref: ref})
+			}
+			for i := range config.Dests {
+				config.Dests[i].Tags = append(config.Dests[i].Tags, flagTags...)
+			}
+			for _, label := range flagLabels {
+				k, v, found := strings.Cut(label, "=")
+				if !found {
+					return nil, nil, false, fmt.Errorf("invalid --label %s, must be KEY=VALUE", label)
+				}
+				if config.Labels == nil {
+					config.Labels = map[string]string{}
+				}
+				config.Labels[k] = v
+			}
+			if *flagArch != "" {
+				config.Architecture = *flagArch
+			}
+			if *flagFromPull != "" {
+				config.FromPull = *flagFromPull
+			}
+			if flagAuthFile != "" {
+				config.AuthFile = flagAuthFile
+			}
+			if err := resolveConfigSecrets(config); err != nil {
+				return nil, nil, false, err
+			}
+		}
+		return configJson, configs, multiImage, nil
+	}
+
+	if validate {
+		configJson, configs, _, err := loadConfigs()
+		if err != nil {
+			return err
+		}
+		return validateCommand(configPath, configJson, configs)
+	}
+
+	pulled := map[dinkerlib.AbsPath]bool{}
+	build := func() error {
+		_, configs, multiImage, err := loadConfigs()
+		if err != nil {
+			return err
+		}
+		for _, config := range configs {
+			logResolvedConfig(config)
+		}
+		// Containers/image uses the proxy env vars, read once on the first request
+		if err := applyProxyEnv(configs); err != nil {
+			return err
+		}
+		if !multiImage {
+			result, err := buildConfig(ctx, configs[0], *dryRun, pulled)
+			if err != nil {
+				return err
+			}
+			return writeResult(*resultFile, result)
+		}
+		results := []Result{}
+		for i, config := range configs {
+			logEvent("image_start", logFields{"image": i}, "Building image %d of %d...", i+1, len(configs))
+			result, err := buildConfig(ctx, config, *dryRun, pulled)
+			if err != nil {
+				return fmt.Errorf("error building image %d: %w", i, err)
+			}
+			results = append(results, result)
+		}
+		return writeResult(*resultFile, results)
+	}
+	if !*watch {
+		return build()
+	}
+
+	// Rebuild whenever the config or build inputs change, until interrupted
+	for {
+		if err := build(); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.Printf("Build failed: %s", err)
+		}
+		// Based on the state after building, since building may create inputs (ex:
+		// pulling FROM)
+		stamp := watchStamp(configPath, loadConfigs)
+		logInfo("Watching for changes...")
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(*watchInterval):
+			}
+			if watchStamp(configPath, loadConfigs) != stamp {
+				break
+			}
+		}
+		logEvent("watch_change", logFields{}, "Change detected, rebuilding")
+		// Re-pull according to from_refresh
+		pulled = map[dinkerlib.AbsPath]bool{}
+	}
+}
+
+// Summarize the config and the metadata of all the files it references, to detect
+// changes
+func watchStamp(configPath string, loadConfigs func() ([]byte, []Config, bool, error)) string {
+	configJson, configs, _, err := loadConfigs()
+	if err != nil {
+		// Rebuild when it's fixed
+		return fmt.Sprintf("error: %s", err)
+	}
+	stamps := []string{string(configJson)}
+	for _, config := range configs {
+		stamp, err := dinkerlib.StatBuildInputs(dinkerlib.BuildImageArgs{
+			FromPath:      config.From,
+			FromRootfs:    config.FromRootfs,
+			CopyFrom:      config.CopyFrom,
+			Platforms:     config.Platforms,
+			Files:         config.Files,
+			Dirs:          config.Dirs,
+			Devices:       config.Devices,
+			Remove:        config.Remove,
+			Nix:           config.Nix,
+			CaCertsSource: config.CaCertsSource,
+			Layers:        config.Layers,
+		})
 		if err != nil {
-			return fmt.Errorf("error reading config at %s: %w", os.Args[1], err)
+			// Ex: a source is missing temporarily
+			stamp = fmt.Sprintf("error: %s", err)
 		}
+		stamps = append(stamps, stamp)
 	}
-	var config Config
-	err := json.Unmarshal(args0, &config)
+	return strings.Join(stamps, "\x00")
+}
+
+// The system context for pulling FROM (and copy_from) images, with the FROM
+// registry settings and credentials. The returned cleanup function deletes temp
+// files.
+func fromSystemContext(config Config) (*types.SystemContext, func(), error) {
+	fromSysCtx, cleanup, err := registryArgs{
+		Http:       config.FromHttp,
+		Host:       config.FromHost,
+		CaCert:     config.FromCaCert,
+		ClientCert: config.FromClientCert,
+		ClientKey:  config.FromClientKey,
+		AuthFile:   config.AuthFile,
+	}.systemContext()
 	if err != nil {
-		return fmt.Errorf("error parsing config json at %s: %w", os.Args[1], err)
+		return nil, nil, err
+	}
+	fromSysCtx.ArchitectureChoice = config.Architecture
+	fromSysCtx.OSChoice = config.Os
+	fromSysCtx.VariantChoice = config.Variant
+	if config.FromToken != "" && (config.FromUser != "" || config.FromPassword != "" || config.FromIdentityToken != "") {
+		cleanup()
+		return nil, nil, fmt.Errorf("from_token can't be used with other FROM credentials")
+	}
+	fromSysCtx.DockerBearerRegistryToken = config.FromToken
+	if config.FromUser != "" || config.FromPassword != "" || config.FromIdentityToken != "" {
+		fromSysCtx.DockerAuthConfig = &types.DockerAuthConfig{
+			Username:      config.FromUser,
+			Password:      config.FromPassword,
+			IdentityToken: config.FromIdentityToken,
+		}
+	}
+	if config.FromAuth != "" && (config.FromUser != "" || config.FromPassword != "" || config.FromToken != "" || config.FromIdentityToken != "") {
+		cleanup()
+		return nil, nil, fmt.Errorf("from_auth can't be used with other FROM credentials")
+	}
+	// Otherwise credentials are looked up in docker/podman auth files, including
+	// running credential helpers
+	if len(config.Mirrors) != 0 {
+		registriesConf, err := writeMirrorsConf(config.Mirrors)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		fromSysCtx.SystemRegistriesConfPath = registriesConf
+		innerCleanup := cleanup
+		cleanup = func() {
+			if err := os.Remove(registriesConf); err != nil {
+				log.Printf("Error deleting temp registries config at %s: %s", registriesConf, err)
+			}
+			innerCleanup()
+		}
 	}
+	return fromSysCtx, cleanup, nil
+}
 
-	if config.From == "" && config.Os == "" && config.Architecture == "" {
-		return fmt.Errorf("missing FROM ref in config")
+// Build the image and push it to all the dests. `pulled` is FROM images pulled
+// so far, so images sharing a FROM only pull it once.
+func buildConfig(ctx context.Context, config Config, dryRun bool, pulled map[dinkerlib.AbsPath]bool) (Result, error) {
+	if config.Created.IsZero() {
+		if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+			epoch1, err := strconv.ParseInt(epoch, 10, 64)
+			if err != nil {
+				return Result{}, fmt.Errorf("SOURCE_DATE_EPOCH %s is not a valid integer: %w", epoch, err)
+			}
+			config.Created = time.Unix(epoch1, 0).UTC()
+		}
 	}
-	if len(config.Files) == 0 {
-		return fmt.Errorf("missing files to add in config")
+
+	if errs := append(checkConfig(config), checkConfigFiles(config)...); len(errs) != 0 {
+		return Result{}, errors.Join(errs...)
 	}
-	if len(config.Dests) == 0 {
-		return fmt.Errorf("missing dests in config")
+
+	if config.FromDaemon != "" {
+		if config.From == "" {
+			fromDir, err := os.MkdirTemp("", ".dinker-from-*")
+			if err != nil {
+				return Result{}, fmt.Errorf("unable to create temp dir to export FROM image to: %w", err)
+			}
+			defer func() {
+				if err := os.RemoveAll(fromDir); err != nil {
+					log.Printf("Error deleting temp FROM image dir at %s: %s", fromDir, err)
+				}
+			}()
+			config.From = dinkerlib.MakeAbsPath(filepath.Join(fromDir, "from.tar"))
+		} else if config.From.Exists() {
+			// Local images change frequently, always re-export
+			if err := os.Remove(config.From.Raw()); err != nil {
+				return Result{}, fmt.Errorf("error removing previously exported FROM image at %s: %w", config.From, err)
+			}
+		}
+		config.FromPull = "docker-daemon:" + config.FromDaemon
 	}
 
 	var policy *signature.Policy
@@ -94,7 +900,7 @@ func main0() error {
 		var err error
 		policy, err = signature.DefaultPolicy(nil)
 		if err != nil {
-			return fmt.Errorf("error setting up docker registry client policy context signature: %w", err)
+			return Result{}, fmt.Errorf("error setting up docker registry client policy context signature: %w", err)
 		}
 	} else {
 		policyJson, _ := json.Marshal(map[string]any{
@@ -113,155 +919,781 @@ func main0() error {
 		})
 		policy, err = signature.NewPolicyFromBytes(policyJson)
 		if err != nil {
-			return fmt.Errorf("error setting up docker registry client policy context signature: %w", err)
+			return Result{}, fmt.Errorf("error setting up docker registry client policy context signature: %w", err)
 		}
 	}
 	policyContext, err := signature.NewPolicyContext(policy)
 	if err != nil {
-		return fmt.Errorf("error setting up docker registry client policy context: %w", err)
+		return Result{}, fmt.Errorf("error setting up docker registry client policy context: %w", err)
+	}
+
+	if config.From != "" {
+		fromSysCtx, cleanup, err := fromSystemContext(config)
+		if err != nil {
+			return Result{}, err
+		}
+		defer cleanup()
+		var sourceRef types.ImageReference
+		if config.FromPull != "" {
+			var err error
+			sourceRef, err = alltransports.ParseImageName(config.FromPull)
+			if err != nil {
+				return Result{}, fmt.Errorf("error parsing FROM pull ref %s: %w", config.FromPull, err)
+			}
+		}
+		// Credentials from auth modes are short lived, so only get them when needed
+		fromAuth := func() error {
+			if config.FromAuth == "" || fromSysCtx.DockerAuthConfig != nil {
+				return nil
+			}
+			auth, err := registryAuth(ctx, config.FromAuth, sourceRef, fromSysCtx)
+			if err != nil {
+				return fmt.Errorf("error getting credentials for FROM pull ref %s: %w", config.FromPull, err)
+			}
+			fromSysCtx.DockerAuthConfig = auth
+			return nil
+		}
+		// Digest of the source image, stored when pulling to check for changes later
+		digestPath := config.From.Raw() + ".digest"
+		remoteDigest := func() (digest.Digest, error) {
+			if err := fromAuth(); err != nil {
+				return "", err
+			}
+			source, err := sourceRef.NewImageSource(ctx, fromSysCtx)
+			if err != nil {
+				return "", fmt.Errorf("error accessing FROM pull ref %s: %w", config.FromPull, err)
+			}
+			defer source.Close()
+			manifestBytes, _, err := source.GetManifest(ctx, nil)
+			if err != nil {
+				return "", fmt.Errorf("error getting manifest for FROM pull ref %s: %w", config.FromPull, err)
+			}
+			return manifest.Digest(manifestBytes)
+		}
+
+		pull := false
+		if !config.From.Exists() {
+			if config.FromPull == "" {
+				return Result{}, fmt.Errorf("no FROM image exists at %s, and no pull ref configured to pull from", config.From)
+			}
+			pull = true
+		} else if config.FromPull != "" && !pulled[config.From] {
+			// (Skipped if pulled for an earlier image in this run)
+			refresh := config.FromRefresh
+			if refresh == "" {
+				refresh = "never"
+			}
+			switch {
+			case refresh == "never":
+			case refresh == "always":
+				pull = true
+			case strings.HasPrefix(refresh, "ttl:"):
+				ttl, err := time.ParseDuration(strings.TrimPrefix(refresh, "ttl:"))
+				if err != nil {
+					return Result{}, fmt.Errorf("invalid from_refresh ttl %s: %w", refresh, err)
+				}
+				stat, err := os.Stat(config.From.Raw())
+				if err != nil {
+					return Result{}, fmt.Errorf("error looking up metadata for FROM image at %s: %w", config.From, err)
+				}
+				pull = time.Since(stat.ModTime()) > ttl
+			case refresh == "digest-check":
+				localDigest, err := os.ReadFile(digestPath)
+				if err != nil && !os.IsNotExist(err) {
+					return Result{}, fmt.Errorf("error reading FROM image digest at %s: %w", digestPath, err)
+				}
+				d, err := remoteDigest()
+				if err != nil {
+					return Result{}, err
+				}
+				pull = string(localDigest) != d.String()
+			default:
+				return Result{}, fmt.Errorf("invalid from_refresh %s, must be one of never, always, ttl:DURATION, or digest-check", refresh)
+			}
+		}
+
+		if pull {
+			logEvent("pull_start", logFields{"ref": config.FromPull, "path": config.From}, "Pulling from image...")
+			if err := fromAuth(); err != nil {
+				return Result{}, err
+			}
+			if config.From.Exists() {
+				if err := os.Remove(config.From.Raw()); err != nil {
+					return Result{}, fmt.Errorf("error removing stale FROM image at %s: %w", config.From, err)
+				}
+			}
+			// Each platform selects its own image from FROM
+			fromImageSelection := imagecopy.CopySystemImage
+			if len(config.Platforms) != 0 {
+				fromImageSelection = imagecopy.CopyAllImages
+			}
+			destRef, err := archive.Transport.ParseReference(config.From.Raw())
+			if err != nil {
+				panic(err)
+			}
+			_, err = imagecopy.Image(
+				ctx,
+				policyContext,
+				destRef,
+				sourceRef,
+				&imagecopy.Options{
+					SourceCtx:            fromSysCtx,
+					ImageListSelection:   fromImageSelection,
+					MaxParallelDownloads: uint(config.MaxTransfers),
+				},
+			)
+			if err != nil {
+				return Result{}, fmt.Errorf("error pulling FROM image %s: %w", config.FromPull, err)
+			}
+			if config.FromRefresh == "digest-check" {
+				d, err := remoteDigest()
+				if err != nil {
+					return Result{}, err
+				}
+				if err := os.WriteFile(digestPath, []byte(d.String()), 0o644); err != nil {
+					return Result{}, fmt.Errorf("error writing FROM image digest to %s: %w", digestPath, err)
+				}
+			}
+			pulled[config.From] = true
+			logEvent("pull_done", logFields{"ref": config.FromPull, "path": config.From}, "Pulling from image... done.")
+		}
+	}
+
+	// Pull missing copy_from images, with the FROM registry settings
+	for i, pullRef := range config.CopyFromPull {
+		copyFrom := config.CopyFrom[i]
+		if pullRef == "" || copyFrom.Exists() {
+			continue
+		}
+		err := func() error {
+			sysCtx, cleanup, err := fromSystemContext(config)
+			if err != nil {
+				return err
+			}
+			defer cleanup()
+			sourceRef, err := alltransports.ParseImageName(pullRef)
+			if err != nil {
+				return fmt.Errorf("error parsing copy_from pull ref %s: %w", pullRef, err)
+			}
+			if config.FromAuth != "" && sysCtx.DockerAuthConfig == nil {
+				auth, err := registryAuth(ctx, config.FromAuth, sourceRef, sysCtx)
+				if err != nil {
+					return fmt.Errorf("error getting credentials for copy_from pull ref %s: %w", pullRef, err)
+				}
+				sysCtx.DockerAuthConfig = auth
+			}
+			logEvent("pull_start", logFields{"ref": pullRef, "path": copyFrom}, "Pulling copy_from image %s...", pullRef)
+			imageSelection := imagecopy.CopySystemImage
+			if len(config.Platforms) != 0 {
+				imageSelection = imagecopy.CopyAllImages
+			}
+			destRef, err := archive.Transport.ParseReference(copyFrom.Raw())
+			if err != nil {
+				panic(err)
+			}
+			_, err = imagecopy.Image(
+				ctx,
+				policyContext,
+				destRef,
+				sourceRef,
+				&imagecopy.Options{
+					SourceCtx:            sysCtx,
+					ImageListSelection:   imageSelection,
+					MaxParallelDownloads: uint(config.MaxTransfers),
+				},
+			)
+			if err != nil {
+				return fmt.Errorf("error pulling copy_from image %s: %w", pullRef, err)
+			}
+			logEvent("pull_done", logFields{"ref": pullRef, "path": copyFrom}, "Pulling copy_from image %s... done.", pullRef)
+			return nil
+		}()
+		if err != nil {
+			return Result{}, err
+		}
 	}
 
-	if config.From != "" && !config.From.Exists() {
-		if config.FromPull == "" {
-			return fmt.Errorf("no FROM image exists at %s, and no pull ref configured to pull from", config.From)
+	// Streamed images are written straight to the dest, so there's no layout dir
+	streaming := config.Stream && !dryRun
+	var destDirPath dinkerlib.AbsPath
+	if config.OutputDir != "" {
+		destDirPath = config.OutputDir
+	} else if !streaming {
+		if err := os.MkdirAll(os.TempDir(), 0o755); err != nil && !os.IsNotExist(err) {
+			return Result{}, fmt.Errorf("temp dir doesn't exist and couldn't create it, unable to write generated image: %w", err)
 		}
-		log.Printf("Pulling from image...")
-		sourceRef, err := alltransports.ParseImageName(config.FromPull)
+		t, err := os.MkdirTemp("", ".dinker-image-*")
 		if err != nil {
-			return fmt.Errorf("error parsing FROM pull ref %s: %w", config.FromPull, err)
+			return Result{}, fmt.Errorf("unable to create temp file to write generated image to: %w", err)
 		}
-		destRef, err := archive.Transport.ParseReference(config.From.Raw())
+		t0, err := filepath.Abs(t)
 		if err != nil {
 			panic(err)
 		}
-		var noHttpVerify types.OptionalBool
-		if config.FromHttp {
-			noHttpVerify = types.OptionalBoolTrue
-		}
-		_, err = imagecopy.Image(
-			context.TODO(),
-			policyContext,
-			destRef,
-			sourceRef,
-			&imagecopy.Options{
-				SourceCtx: &types.SystemContext{
-					DockerInsecureSkipTLSVerify:       noHttpVerify,
-					DockerDaemonHost:                  config.FromHost,
-					DockerDaemonInsecureSkipTLSVerify: config.FromHttp,
-					OCIInsecureSkipTLSVerify:          config.FromHttp,
-					DockerAuthConfig: &types.DockerAuthConfig{
-						Username: config.FromUser,
-						Password: config.FromPassword,
-					},
-				},
-			},
-		)
+		destDirPath = dinkerlib.AbsPath(t0)
+		defer func() {
+			if err := os.RemoveAll(destDirPath.Raw()); err != nil {
+				log.Printf("Error deleting temp image dir at %s: %s", destDirPath, err)
+			}
+		}()
+	}
+
+	var sbomPath dinkerlib.AbsPath
+	sbomName := ""
+	var sbomPackages []dinkerlib.BuildImageArgsSbomPackage
+	if config.Sbom != nil {
+		sbomPath = dinkerlib.Def(config.Sbom.Path, destDirPath.Join("sbom.spdx.json"))
+		sbomName = config.Sbom.Name
+		if sbomName == "" && len(config.Dests) != 0 {
+			sbomName = config.Dests[0].Ref
+		}
+		sbomName = dinkerlib.Def(sbomName, "image")
+		sbomPackages = config.Sbom.Packages
+	}
+
+	var subject *imagespec.Descriptor
+	if config.Subject != nil {
+		subject, err = resolveSubject(ctx, *config.Subject, config.AuthFile)
 		if err != nil {
-			return fmt.Errorf("error pulling FROM image %s: %w", config.FromPull, err)
+			return Result{}, err
 		}
-		log.Printf("Pulling from image... done.")
+	}
+	artifacts := config.Artifacts
+	if config.Sbom != nil {
+		artifacts = append(artifacts, ConfigArtifact{Path: sbomPath, Type: sbomMediaType})
 	}
 
-	if err := os.MkdirAll(os.TempDir(), 0o755); err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("temp dir doesn't exist and couldn't create it, unable to write generated image: %w", err)
+	// Configured labels replace the standard ones
+	labels := config.Labels
+	var annotations map[string]string
+	if config.StandardAnnotations != nil {
+		annotations, err = standardAnnotations(config)
+		if err != nil {
+			return Result{}, err
+		}
+		labels = map[string]string{}
+		for k, v := range annotations {
+			labels[k] = v
+		}
+		for k, v := range config.Labels {
+			labels[k] = v
+		}
 	}
-	t, err := os.MkdirTemp("", ".dinker-image-*")
+
+	buildArgs := dinkerlib.BuildImageArgs{
+		FromPath:           config.From,
+		FromRootfs:         config.FromRootfs,
+		CopyFrom:           config.CopyFrom,
+		Architecture:       config.Architecture,
+		Os:                 config.Os,
+		Variant:            config.Variant,
+		Platforms:          config.Platforms,
+		OsVersion:          config.OsVersion,
+		OsFeatures:         config.OsFeatures,
+		Files:              config.Files,
+		Dirs:               config.Dirs,
+		Devices:            config.Devices,
+		Remove:             config.Remove,
+		Nix:                config.Nix,
+		IncludeCaCerts:     config.IncludeCaCerts,
+		CaCertsSource:      config.CaCertsSource,
+		Layers:             config.Layers,
+		ClearEnv:           config.ClearEnv,
+		RemoveEnv:          config.RemoveEnv,
+		AddEnv:             config.AddEnv,
+		WorkingDir:         config.WorkingDir,
+		ClearWorkingDir:    config.ClearWorkingDir,
+		User:               config.User,
+		ClearUser:          config.ClearUser,
+		CreateUser:         config.CreateUser,
+		Entrypoint:         config.Entrypoint,
+		ClearEntrypoint:    config.ClearEntrypoint,
+		Cmd:                config.Cmd,
+		ClearCmd:           config.ClearCmd,
+		Shell:              config.Shell,
+		Ports:              config.Ports,
+		ClearPorts:         config.ClearPorts,
+		RemovePorts:        config.RemovePorts,
+		Volumes:            config.Volumes,
+		ClearVolumes:       config.ClearVolumes,
+		RemoveVolumes:      config.RemoveVolumes,
+		StopSignal:         config.StopSignal,
+		ClearStopSignal:    config.ClearStopSignal,
+		Labels:             labels,
+		ClearLabels:        config.ClearLabels,
+		Author:             config.Author,
+		Annotations:        annotations,
+		Created:            config.Created,
+		Reproducible:       config.Reproducible,
+		Squash:             config.Squash,
+		MaxLayerSize:       config.MaxLayerSize,
+		Compression:        config.Compression,
+		CompressionThreads: config.CompressionThreads,
+		CacheDir:           config.CacheDir,
+		Subject:            subject,
+		SbomPath:           sbomPath,
+		SbomName:           sbomName,
+		SbomPackages:       sbomPackages,
+		DestDirPath:        destDirPath,
+	}
+
+	fromLayers, err := fromMountLayers(config)
 	if err != nil {
-		return fmt.Errorf("unable to create temp file to write generated image to: %w", err)
+		return Result{}, err
+	}
+
+	if streaming {
+		result, err := streamPush(ctx, config.Dests[0], buildArgs, timeRefVars(config.Created), config.FromPull, fromLayers, config.AuthFile)
+		if err != nil {
+			return Result{}, err
+		}
+		return result, nil
+	}
+
+	// Reuse the image from the previous build in the output dir if nothing changed
+	statePath := destDirPath.Join(".dinker-build.json")
+	hash := ""
+	inputsHash := ""
+	if config.SkipUnchanged {
+		inputsHash, err = dinkerlib.HashBuildInputs(buildArgs)
+		if err != nil {
+			return Result{}, fmt.Errorf("error hashing build inputs: %w", err)
+		}
+		stateJson, err := os.ReadFile(statePath.Raw())
+		if err != nil && !os.IsNotExist(err) {
+			return Result{}, fmt.Errorf("error reading previous build state at %s: %w", statePath, err)
+		}
+		if err == nil {
+			var state BuildState
+			if err := json.Unmarshal(stateJson, &state); err != nil {
+				return Result{}, fmt.Errorf("error parsing previous build state at %s: %w", statePath, err)
+			}
+			logVerbose("Build inputs hash %s, previous %s", inputsHash, state.Inputs)
+			if state.Inputs == inputsHash {
+				logEvent("build_reused", logFields{"hash": state.Hash, "output_dir": destDirPath}, "Build inputs unchanged, reusing image in %s", destDirPath)
+				hash = state.Hash
+			}
+		}
+	}
+	if hash == "" {
+		if config.OutputDir != "" {
+			// Clear the previous build's layout, but don't delete anything that isn't an
+			// image layout
+			entries, err := os.ReadDir(destDirPath.Raw())
+			if err != nil && !os.IsNotExist(err) {
+				return Result{}, fmt.Errorf("error reading output dir at %s: %w", destDirPath, err)
+			}
+			if len(entries) > 0 {
+				layoutPath := destDirPath.Join("oci-layout")
+				if !layoutPath.Exists() {
+					return Result{}, fmt.Errorf("output dir at %s isn't empty and doesn't contain an OCI image layout, refusing to overwrite", destDirPath)
+				}
+				for _, e := range entries {
+					if err := os.RemoveAll(destDirPath.Join(e.Name()).Raw()); err != nil {
+						return Result{}, fmt.Errorf("error clearing previous image from output dir at %s: %w", destDirPath, err)
+					}
+				}
+			}
+		}
+		logEvent("build_start", logFields{}, "Building image...")
+		hash, err = dinkerlib.BuildImageContext(ctx, buildArgs)
+		if err != nil {
+			return Result{}, fmt.Errorf("error building image: %w", err)
+		}
+		logEvent("build_done", logFields{"hash": hash}, "Building image... done.")
+		logVerbose("Build hash %s", hash)
+		if config.SkipUnchanged {
+			stateJson, err := json.Marshal(BuildState{
+				Inputs: inputsHash,
+				Hash:   hash,
+			})
+			if err != nil {
+				panic(err)
+			}
+			if err := os.WriteFile(statePath.Raw(), stateJson, 0o644); err != nil {
+				return Result{}, fmt.Errorf("error writing build state to %s: %w", statePath, err)
+			}
+		}
 	}
-	t0, err := filepath.Abs(t)
+	sourceRef, err := ocidir.Transport.ParseReference(destDirPath.Raw())
 	if err != nil {
 		panic(err)
 	}
-	destDirPath := dinkerlib.AbsPath(t0)
-	defer func() {
-		if err := os.RemoveAll(destDirPath.Raw()); err != nil {
-			log.Printf("Error deleting temp image dir at %s: %s", destDirPath, err)
-		}
-	}()
-
-	log.Printf("Building image...")
-	hash, err := dinkerlib.BuildImage(dinkerlib.BuildImageArgs{
-		FromPath:     config.From,
-		Architecture: config.Architecture,
-		Os:           config.Os,
-		Files:        config.Files,
-		ClearEnv:     config.ClearEnv,
-		AddEnv:       config.AddEnv,
-		WorkingDir:   config.WorkingDir,
-		User:         config.User,
-		Entrypoint:   config.Entrypoint,
-		Cmd:          config.Cmd,
-		Ports:        config.Ports,
-		StopSignal:   config.StopSignal,
-		Labels:       config.Labels,
-		DestDirPath:  destDirPath,
-	})
+	builtSource, err := sourceRef.NewImageSource(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("error building image: %w", err)
+		return Result{}, fmt.Errorf("error opening built image: %w", err)
 	}
-	log.Printf("Building image... done.")
-	sourceRef, err := ocidir.Transport.ParseReference(destDirPath.Raw())
+	builtManifest, builtManifestType, err := builtSource.GetManifest(ctx, nil)
+	builtSource.Close()
 	if err != nil {
-		panic(err)
+		return Result{}, fmt.Errorf("error reading built image manifest: %w", err)
+	}
+	builtManifestDigest, err := manifest.Digest(builtManifest)
+	if err != nil {
+		return Result{}, fmt.Errorf("error digesting built image manifest: %w", err)
+	}
+	multiPlatform := manifest.MIMETypeIsMultiImage(builtManifestType)
+	result := Result{
+		Hash:           hash,
+		ManifestDigest: builtManifestDigest,
+		Dests:          []ResultDest{},
 	}
+	refVars := timeRefVars(config.Created)
+	refVars["hash"] = hash
+	refVars["short_hash"] = hash[:8]
+	var builtConfig digest.Digest
+	var sizes []ImageSize
+	if multiPlatform {
+		builtIndex, err := manifest.OCI1IndexFromManifest(builtManifest)
+		if err != nil {
+			return Result{}, fmt.Errorf("error parsing built image index: %w", err)
+		}
+		result.Manifests = builtIndex.Manifests
+		logEvent("built", logFields{
+			"manifest_digest": builtManifestDigest,
+			"images":          len(builtIndex.Manifests),
+		}, "Built image index %s, %d images", builtManifestDigest, len(builtIndex.Manifests))
+		for _, m := range builtIndex.Manifests {
+			logVerbose("Built image %s for %s/%s", m.Digest, m.Platform.OS, m.Platform.Architecture)
+		}
+		sizes, err = measureIndex(destDirPath, builtIndex.Index)
+		if err != nil {
+			return Result{}, fmt.Errorf("error measuring built images: %w", err)
+		}
+		result.Sizes = sizes
+	} else {
+		builtImg, err := sourceRef.NewImage(ctx, nil)
+		if err != nil {
+			return Result{}, fmt.Errorf("error opening built image: %w", err)
+		}
+		builtConfig = builtImg.ConfigInfo().Digest
+		builtOciConfig, err := builtImg.OCIConfig(ctx)
+		builtImg.Close()
+		if err != nil {
+			return Result{}, fmt.Errorf("error reading built image config: %w", err)
+		}
+		builtOciManifest, err := manifest.OCI1FromManifest(builtManifest)
+		if err != nil {
+			return Result{}, fmt.Errorf("error parsing built image manifest: %w", err)
+		}
+		result.ConfigDigest = builtConfig
+		result.Layers = builtOciManifest.Layers
+		refVars["arch"] = builtOciConfig.Architecture
+		refVars["os"] = builtOciConfig.OS
 
-	for i, dest := range config.Dests {
-		destString := dest.Ref
-		if destString == "" {
-			panic(fmt.Sprintf("Missing ref in dest %d", i))
+		size := builtOciManifest.Config.Size
+		for _, l := range builtOciManifest.Layers {
+			size += l.Size
+		}
+		logEvent("built", logFields{
+			"manifest_digest": builtManifestDigest,
+			"config_digest":   builtConfig,
+			"layers":          len(builtOciManifest.Layers),
+			"bytes":           size,
+		}, "Built image manifest %s, config %s, %d layers, %d bytes", builtManifestDigest, builtConfig, len(builtOciManifest.Layers), size)
+		for _, l := range builtOciManifest.Layers {
+			logVerbose("Layer %s, %s, %d bytes", l.Digest, l.MediaType, l.Size)
+		}
+		imageSize, err := measureImage(destDirPath, builtOciManifest.Manifest)
+		if err != nil {
+			return Result{}, fmt.Errorf("error measuring built image: %w", err)
+		}
+		result.Size = &imageSize
+		sizes = []ImageSize{imageSize}
+	}
+	for _, size := range sizes {
+		logImageSize(size)
+		if config.MaxImageSize != 0 && size.Size > config.MaxImageSize {
+			return Result{}, fmt.Errorf("built image size %d bytes is larger than max_image_size %d bytes", size.Size, config.MaxImageSize)
+		}
+	}
+
+	// Expand tags into separate dests, blobs uploaded for the first are reused for
+	// the rest
+	dests := []ConfigDest{}
+	for _, dest := range config.Dests {
+		for _, ref := range destRefs(dest) {
+			tagDest := dest
+			tagDest.Ref = ref
+			dests = append(dests, tagDest)
+		}
+	}
+
+	for _, dest := range dests {
+		destString, err := expandDestRef(dest.Ref, refVars)
+		if err != nil {
+			return Result{}, err
+		}
+		if dryRun {
+			if !strings.HasPrefix(destString, "containerd:") {
+				if _, err := alltransports.ParseImageName(destString); err != nil {
+					return Result{}, fmt.Errorf("invalid dest image ref %s: %w", destString, err)
+				}
+			}
+			logEvent("push_dry_run", logFields{"ref": destString}, "Dry run, would push to %s", destString)
+			result.Dests = append(result.Dests, ResultDest{Ref: destString})
+			continue
 		}
-		for k, v := range map[string]string{
-			"hash":       hash,
-			"short_hash": hash[:8],
-		} {
-			destString = strings.ReplaceAll(destString, fmt.Sprintf("{%s}", k), v)
+		if name, found := strings.CutPrefix(destString, "containerd:"); found {
+			logEvent("push_start", logFields{"ref": destString}, "Pushing to %s...", destString)
+			if err := pushContainerd(ctx, policyContext, sourceRef, name, dest.Host, dest.Namespace); err != nil {
+				return Result{}, fmt.Errorf("error pushing to %s: %w", destString, err)
+			}
+			logEvent("push_done", logFields{"ref": destString}, "Pushing to %s... done.", destString)
+			result.Dests = append(result.Dests, ResultDest{Ref: destString})
+			continue
 		}
 		destRef, err := alltransports.ParseImageName(destString)
 		if err != nil {
-			return fmt.Errorf("invalid dest image ref %s: %w", destString, err)
+			return Result{}, fmt.Errorf("invalid dest image ref %s: %w", destString, err)
 		}
 
-		log.Printf("Pushing to %s...", destString)
-		var noHttpVerify types.OptionalBool
-		if dest.Http {
-			noHttpVerify = types.OptionalBoolTrue
+		logEvent("push_start", logFields{"ref": destString}, "Pushing to %s...", destString)
+		destSysCtx, cleanup, err := dest.systemContext(ctx, destString, destRef, config.AuthFile)
+		if err != nil {
+			return Result{}, err
 		}
-		destSysCtx := types.SystemContext{
-			DockerInsecureSkipTLSVerify:       noHttpVerify,
-			DockerDaemonHost:                  dest.Host,
-			DockerDaemonInsecureSkipTLSVerify: dest.Http,
-			OCIInsecureSkipTLSVerify:          dest.Http,
-			DockerAuthConfig: &types.DockerAuthConfig{
-				Username: dest.User,
-				Password: dest.Password,
-			},
+		defer cleanup()
+		if destRef.Transport().Name() == docker.Transport.Name() {
+			// Read by the copy below, which mounts blobs with known locations in the same
+			// registry
+			recordFromLayerLocations(blobinfocache.DefaultCache(destSysCtx), config.FromPull, fromLayers)
+		}
+		if dest.SkipExisting {
+			upToDate, existingDigest := false, digest.Digest("")
+			if multiPlatform {
+				// Indexes are pushed as-is
+				existing, err := destRef.NewImageSource(ctx, destSysCtx)
+				if err == nil {
+					existingManifest, _, err := existing.GetManifest(ctx, nil)
+					existing.Close()
+					if err == nil {
+						existingDigest, err = manifest.Digest(existingManifest)
+						upToDate = err == nil && existingDigest == builtManifestDigest
+					}
+				}
+			} else {
+				// The manifest may be converted when pushing, but the config is pushed as-is,
+				// so compare that instead
+				existing, err := destRef.NewImage(ctx, destSysCtx)
+				if err == nil {
+					existingConfig := existing.ConfigInfo().Digest
+					existingManifest, _, err := existing.Manifest(ctx)
+					existing.Close()
+					if err == nil {
+						existingDigest, err = manifest.Digest(existingManifest)
+						upToDate = err == nil && existingConfig == builtConfig
+					}
+				}
+			}
+			if upToDate {
+				logEvent("push_skipped", logFields{
+					"ref":             destString,
+					"manifest_digest": existingDigest,
+				}, "Image at %s is already up to date, skipping push", destString)
+				result.Dests = append(result.Dests, ResultDest{
+					Ref:            destString,
+					ManifestDigest: existingDigest,
+					Skipped:        true,
+				})
+				continue
+			}
+		}
+		// Docker archives can't be overwritten, so remove any archive from a previous
+		// build (or failed attempt) first
+		clearDest := func() error {
+			if destRef.Transport().Name() != "docker-archive" {
+				return nil
+			}
+			path, _, _ := strings.Cut(destRef.StringWithinTransport(), ":")
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("error removing existing docker archive at %s: %w", path, err)
+			}
+			return nil
+		}
+		if err := clearDest(); err != nil {
+			return Result{}, err
+		}
+		var signers []*signer.Signer
+		if dest.Sign != nil {
+			s, err := dest.Sign.signer()
+			if err != nil {
+				return Result{}, fmt.Errorf("error setting up signing for dest %s: %w", destString, err)
+			}
+			defer s.Close()
+			signers = append(signers, s)
+			registriesD, cleanup, err := writeSigstoreRegistriesD()
+			if err != nil {
+				return Result{}, err
+			}
+			defer cleanup()
+			destSysCtx.RegistriesDirPath = registriesD
 		}
-		destImg, err := destRef.NewImageDestination(context.TODO(), &destSysCtx)
+		destImg, err := destRef.NewImageDestination(ctx, destSysCtx)
 		if err != nil {
-			panic(err)
+			return Result{}, fmt.Errorf("error opening dest %s: %w", destString, err)
 		}
 		manifestFormat := ""
-		for _, format := range destImg.SupportedManifestMIMETypes() {
-			// Prefer docker manifest
-			if format == manifest.DockerV2Schema2MediaType {
-				manifestFormat = format
-			}
-		}
-		_, err = imagecopy.Image(
-			context.TODO(),
-			policyContext,
-			destRef,
-			sourceRef,
-			&imagecopy.Options{
-				ForceManifestMIMEType: manifestFormat,
-				DestinationCtx:        &destSysCtx,
-			},
-		)
+		imageSelection := imagecopy.CopySystemImage
+		if multiPlatform {
+			// Push the index and all images as built
+			imageSelection = imagecopy.CopyAllImages
+		}
+		switch dest.ManifestFormat {
+		case manifestFormatOci:
+			manifestFormat = imagespec.MediaTypeImageManifest
+		case manifestFormatDocker:
+			manifestFormat = manifest.DockerV2Schema2MediaType
+		}
+		if supported := destImg.SupportedManifestMIMETypes(); manifestFormat != "" && supported != nil && !slices.Contains(supported, manifestFormat) {
+			destImg.Close()
+			return Result{}, fmt.Errorf("dest %s doesn't support %s manifests", destString, dest.ManifestFormat)
+		}
+		// Close before copying, otherwise some transports (ex: docker-daemon) are left
+		// with an unfinished upload in progress
+		if err := destImg.Close(); err != nil {
+			return Result{}, fmt.Errorf("error closing dest %s: %w", destString, err)
+		}
+		retryDelay := time.Second
+		if dest.RetryDelay != "" {
+			retryDelay, err = time.ParseDuration(dest.RetryDelay)
+			if err != nil {
+				return Result{}, fmt.Errorf("invalid retry_delay %s for dest %s: %w", dest.RetryDelay, destString, err)
+			}
+		}
+		var chunkedBlobs []types.BlobInfo
+		if dest.ChunkSize != 0 && destRef.Transport().Name() == docker.Transport.Name() {
+			layers, err := imageLayerInfos(sourceRef)
+			if err != nil {
+				return Result{}, fmt.Errorf("error reading built image layers: %w", err)
+			}
+			chunkedBlobs, err = uploadChunkedBlobs(ctx, destSysCtx, destRef.DockerReference(), dest, retryDelay, destDirPath, layers)
+			if err != nil {
+				return Result{}, fmt.Errorf("error uploading large layers to %s: %w", destString, err)
+			}
+		}
+		var pushedManifest []byte
+		var pushStats PushStats
+		var pushSkipped map[digest.Digest]bool
+		for attempt := 0; ; attempt++ {
+			if attempt > 0 {
+				if err := clearDest(); err != nil {
+					return Result{}, err
+				}
+			}
+			progress, progressInterval, finishStats := collectPushStats()
+			pushedManifest, err = imagecopy.Image(
+				ctx,
+				policyContext,
+				destRef,
+				sourceRef,
+				&imagecopy.Options{
+					ForceManifestMIMEType: manifestFormat,
+					ImageListSelection:    imageSelection,
+					DestinationCtx:        destSysCtx,
+					Signers:               signers,
+					Progress:              progress,
+					ProgressInterval:      progressInterval,
+					MaxParallelDownloads:  uint(config.MaxTransfers),
+				},
+			)
+			pushStats, pushSkipped = finishStats()
+			if err == nil || attempt >= dest.Retries || ctx.Err() != nil {
+				break
+			}
+			log.Printf("Error pushing to %s, retrying in %s: %s", destString, retryDelay, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(retryDelay):
+			}
+			retryDelay *= 2
+		}
+		if err != nil {
+			return Result{}, fmt.Errorf("error uploading image: %w", err)
+		}
+		// The copy should find the blobs uploaded in chunks already present, but only
+		// move them from skipped if it reported them that way
+		for _, b := range chunkedBlobs {
+			pushStats.UploadedBlobs += 1
+			pushStats.UploadedBytes += b.Size
+			if pushSkipped[b.Digest] {
+				pushStats.SkippedBlobs -= 1
+				pushStats.SkippedBytes -= b.Size
+			}
+		}
+		pushedDigest, err := manifest.Digest(pushedManifest)
 		if err != nil {
-			return fmt.Errorf("error uploading image: %w", err)
+			return Result{}, fmt.Errorf("error digesting manifest pushed to %s: %w", destString, err)
 		}
-		log.Printf("Pushing to %s... done.", dest.Ref)
+		logEvent("push_done", pushStats.logFields(logFields{
+			"ref":             destString,
+			"manifest_digest": pushedDigest,
+		}), "Pushing to %s... done, %s.", destString, pushStats)
+		logVerbose("Pushed manifest %s to %s", pushedDigest, destString)
+		if subject != nil || len(artifacts) != 0 {
+			if destRef.Transport().Name() != docker.Transport.Name() {
+				logInfo("Not adding referrers for %s, only supported for registry dests", destString)
+			} else {
+				pushedDescriptor := imagespec.Descriptor{
+					MediaType: manifest.GuessMIMEType(pushedManifest),
+					Digest:    pushedDigest,
+					Size:      int64(len(pushedManifest)),
+				}
+				if subject != nil {
+					// Registries supporting the referrers api index the subject themselves
+					referrer := pushedDescriptor
+					if !multiPlatform {
+						referrer.ArtifactType = imagespec.MediaTypeImageConfig
+					}
+					if err := addReferrersTag(ctx, destSysCtx, destRef.DockerReference(), subject.Digest, referrer); err != nil {
+						return Result{}, fmt.Errorf("error adding %s to subject referrers: %w", destString, err)
+					}
+				}
+				for _, a := range artifacts {
+					contents, err := os.ReadFile(a.Path.Raw())
+					if err != nil {
+						return Result{}, fmt.Errorf("error reading artifact at %s: %w", a.Path, err)
+					}
+					artifactDigest, err := pushReferrer(ctx, destSysCtx, destRef, pushedDescriptor, a.Type, contents)
+					if err != nil {
+						return Result{}, fmt.Errorf("error attaching artifact %s to %s: %w", a.Path, destString, err)
+					}
+					logEvent("artifact_attached", logFields{
+						"ref":    destString,
+						"path":   a.Path,
+						"type":   a.Type,
+						"digest": artifactDigest,
+					}, "Attached %s (%s) to %s as %s", a.Path, a.Type, destString, artifactDigest)
+				}
+			}
+		}
+		result.Dests = append(result.Dests, ResultDest{
+			Ref:            destString,
+			ManifestDigest: pushedDigest,
+			Stats:          &pushStats,
+		})
+	}
+
+	return result, nil
+}
+
+// Write the result json to `path` (`-` for stdout), if specified
+func writeResult(path string, result any) error {
+	if path == "" {
+		return nil
+	}
+	resultJson, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	resultJson = append(resultJson, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(resultJson)
+	} else {
+		err = os.WriteFile(path, resultJson, 0o644)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing result to %s: %w", path, err)
 	}
 	return nil
 }
@@ -269,6 +1701,6 @@ func main0() error {
 func main() {
 	err := main0()
 	if err != nil {
-		log.Fatalf("Exiting with fatal error: %s", err)
+		logFatal(err)
 	}
 }
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/oci/archive"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+)
+
+// The layers of a pulled FROM image (all platforms), if it was pulled from a
+// registry
+func fromMountLayers(config Config) ([]digest.Digest, error) {
+	if config.FromPull == "" || config.From == "" || !config.From.Exists() {
+		return nil, nil
+	}
+	fromRef, err := alltransports.ParseImageName(config.FromPull)
+	if err != nil || fromRef.Transport().Name() != docker.Transport.Name() {
+		return nil, nil
+	}
+	ref, err := archive.Transport.ParseReference(config.From.Raw())
+	if err != nil {
+		return nil, fmt.Errorf("error making ref for FROM image %s: %w", config.From, err)
+	}
+	layers, err := imageLayerInfos(ref)
+	if err != nil {
+		return nil, fmt.Errorf("error reading FROM image %s layers: %w", config.From, err)
+	}
+	out := []digest.Digest{}
+	for _, l := range layers {
+		out = append(out, l.Digest)
+	}
+	return out, nil
+}
+
+// The layers of every image in a local image (or index)
+func imageLayerInfos(ref types.ImageReference) ([]types.BlobInfo, error) {
+	ctx := context.TODO()
+	source, err := ref.NewImageSource(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error opening image: %w", err)
+	}
+	defer source.Close()
+	top, topType, err := source.GetManifest(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+	manifests := [][]byte{top}
+	if manifest.MIMETypeIsMultiImage(topType) {
+		list, err := manifest.ListFromBlob(top, topType)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing index: %w", err)
+		}
+		manifests = [][]byte{}
+		for _, d := range list.Instances() {
+			// Only pulled platforms are in pulled images
+			m, _, err := source.GetManifest(ctx, &d)
+			if err != nil {
+				continue
+			}
+			manifests = append(manifests, m)
+		}
+	}
+	out := []types.BlobInfo{}
+	for _, m := range manifests {
+		parsed, err := manifest.FromBlob(m, manifest.GuessMIMEType(m))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing manifest: %w", err)
+		}
+		for _, l := range parsed.LayerInfos() {
+			out = append(out, l.BlobInfo)
+		}
+	}
+	return out, nil
+}
+
+// Record that the FROM layers exist in the repo they were pulled from, so pushes
+// to the same registry mount them from there (cross-repo) instead of uploading
+// them again
+func recordFromLayerLocations(cache types.BlobInfoCache, fromPull string, layers []digest.Digest) {
+	if len(layers) == 0 {
+		return
+	}
+	fromRef, err := alltransports.ParseImageName(fromPull)
+	if err != nil || fromRef.DockerReference() == nil {
+		return
+	}
+	named := fromRef.DockerReference()
+	for _, l := range layers {
+		cache.RecordKnownLocation(
+			docker.Transport,
+			types.BICTransportScope{Opaque: reference.Domain(named)},
+			l,
+			types.BICLocationReference{Opaque: named.Name()},
+		)
+	}
+}
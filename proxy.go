@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/andrewbaxter/dinker/dinkerlib"
+)
+
+// The proxy env vars set by the last build, see applyProxyEnv
+var appliedProxyEnv map[string]string
+
+// From before it's replaced
+var envNoProxy = dinkerlib.Def(os.Getenv("NO_PROXY"), os.Getenv("no_proxy"))
+
+// The registry host of a `docker://` ref, ex: `registry.example.com:5000`. Docker
+// Hub refs give `.docker.io` to match its registry and auth hosts.
+func dockerRefHost(ref string) (string, bool) {
+	rest, found := strings.CutPrefix(ref, "docker://")
+	if !found {
+		return "", false
+	}
+	host, _, found := strings.Cut(strings.TrimPrefix(rest, "//"), "/")
+	if !found || (!strings.ContainsAny(host, ".:") && host != "localhost") || host == "docker.io" {
+		return ".docker.io", true
+	}
+	return host, true
+}
+
+// The proxy env vars for a config, or nil to leave the environment as is
+func configProxyEnv(config Config) map[string]string {
+	out := map[string]string{}
+	if config.Proxy != "" {
+		out["HTTP_PROXY"] = config.Proxy
+		out["HTTPS_PROXY"] = config.Proxy
+	}
+	noProxy := append([]string{}, config.NoProxy...)
+	bypass := false
+	for _, dest := range config.Dests {
+		if !dest.BypassProxy {
+			continue
+		}
+		bypass = true
+		if host, ok := dockerRefHost(dest.Ref); ok {
+			noProxy = append(noProxy, host)
+		}
+	}
+	if bypass {
+		// Keep the hosts from the environment if no_proxy isn't specified
+		if config.NoProxy == nil {
+			if envNoProxy != "" {
+				noProxy = append(strings.Split(envNoProxy, ","), noProxy...)
+			}
+		}
+		sort.Strings(noProxy)
+	}
+	if config.NoProxy != nil || bypass {
+		out["NO_PROXY"] = strings.Join(noProxy, ",")
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// The proxy env vars for all the images in a run. Containers/image only reads
+// the proxy env vars once per process, so the settings must be the same for
+// every image.
+func proxyEnv(configs []Config) (map[string]string, error) {
+	out := configProxyEnv(configs[0])
+	for i, config := range configs[1:] {
+		if !maps.Equal(configProxyEnv(config), out) {
+			return nil, fmt.Errorf("image %d has different proxy, no_proxy, or dest bypass_proxy settings than image 0; they apply to the whole run so must be the same for every image", i+1)
+		}
+	}
+	return out, nil
+}
+
+// Set the proxy env vars for the run, before any registry requests. Since they're
+// only read once, the settings can't change between builds with `--watch`.
+func applyProxyEnv(configs []Config) error {
+	env, err := proxyEnv(configs)
+	if err != nil {
+		return err
+	}
+	if appliedProxyEnv != nil {
+		if !maps.Equal(env, appliedProxyEnv) {
+			return fmt.Errorf("proxy settings changed, restart dinker to use the new settings")
+		}
+		return nil
+	}
+	for k, v := range env {
+		if err := os.Setenv(k, v); err != nil {
+			return fmt.Errorf("error setting %s for proxy: %w", k, err)
+		}
+	}
+	appliedProxyEnv = env
+	if appliedProxyEnv == nil {
+		appliedProxyEnv = map[string]string{}
+	}
+	return nil
+}
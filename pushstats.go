@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+)
+
+// Blobs uploaded and skipped because the dest already had them, for one push
+type PushStats struct {
+	UploadedBlobs int   `json:"uploaded_blobs"`
+	UploadedBytes int64 `json:"uploaded_bytes"`
+	SkippedBlobs  int   `json:"skipped_blobs"`
+	SkippedBytes  int64 `json:"skipped_bytes"`
+}
+
+func (s PushStats) String() string {
+	return fmt.Sprintf("uploaded %d blobs (%d bytes), %d blobs (%d bytes) already present", s.UploadedBlobs, s.UploadedBytes, s.SkippedBlobs, s.SkippedBytes)
+}
+
+func (s PushStats) logFields(fields logFields) logFields {
+	fields["uploaded_blobs"] = s.UploadedBlobs
+	fields["uploaded_bytes"] = s.UploadedBytes
+	fields["skipped_blobs"] = s.SkippedBlobs
+	fields["skipped_bytes"] = s.SkippedBytes
+	return fields
+}
+
+// Collect stats from image copy progress events. Blobs are checked for in the
+// dest before uploading, and those found are reported as skipped. Call the
+// returned function once the copy is done to get the stats and the digests of
+// the skipped blobs.
+func collectPushStats() (chan types.ProgressProperties, time.Duration, func() (PushStats, map[digest.Digest]bool)) {
+	progress := make(chan types.ProgressProperties)
+	stats := PushStats{}
+	skipped := map[digest.Digest]bool{}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for p := range progress {
+			switch p.Event {
+			case types.ProgressEventDone:
+				if p.Offset == 0 && p.Artifact.Size > 0 {
+					// Nothing was read, so the dest found it when checking before uploading (ex:
+					// the config)
+					stats.SkippedBlobs += 1
+					stats.SkippedBytes += p.Artifact.Size
+					skipped[p.Artifact.Digest] = true
+					continue
+				}
+				stats.UploadedBlobs += 1
+				stats.UploadedBytes += int64(p.Offset)
+			case types.ProgressEventSkipped:
+				stats.SkippedBlobs += 1
+				stats.SkippedBytes += p.Artifact.Size
+				skipped[p.Artifact.Digest] = true
+			}
+		}
+	}()
+	// Skip events are only sent with an interval
+	return progress, time.Second, func() (PushStats, map[digest.Digest]bool) {
+		close(progress)
+		wg.Wait()
+		return stats, skipped
+	}
+}
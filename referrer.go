@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/andrewbaxter/dinker/dinkerlib"
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Push an artifact with a single blob to the repository of `ref`, with `subject`
+// as its subject so registries list it in the subject's referrers. Also adds it to
+// the referrers tag schema index for registries without the referrers api.
+func pushReferrer(ctx context.Context, sysCtx *types.SystemContext, ref types.ImageReference, subject imagespec.Descriptor, artifactType string, contents []byte) (digest.Digest, error) {
+	named := ref.DockerReference()
+	if named == nil || ref.Transport().Name() != docker.Transport.Name() {
+		return "", fmt.Errorf("artifacts can only be attached to registry refs (docker://)")
+	}
+	emptyConfig := []byte("{}")
+	artifactManifest, err := json.Marshal(imagespec.Manifest{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		MediaType:    imagespec.MediaTypeImageManifest,
+		ArtifactType: artifactType,
+		Config: imagespec.Descriptor{
+			MediaType: imagespec.MediaTypeEmptyJSON,
+			Digest:    digest.FromBytes(emptyConfig),
+			Size:      int64(len(emptyConfig)),
+		},
+		Layers: []imagespec.Descriptor{
+			{
+				MediaType: artifactType,
+				Digest:    digest.FromBytes(contents),
+				Size:      int64(len(contents)),
+			},
+		},
+		Subject: &subject,
+	})
+	if err != nil {
+		panic(err)
+	}
+	artifactDigest := digest.FromBytes(artifactManifest)
+	digested, err := reference.WithDigest(reference.TrimNamed(named), artifactDigest)
+	if err != nil {
+		panic(err)
+	}
+	artifactRef, err := docker.NewReference(digested)
+	if err != nil {
+		return "", fmt.Errorf("error creating artifact ref: %w", err)
+	}
+	dest, err := artifactRef.NewImageDestination(ctx, sysCtx)
+	if err != nil {
+		return "", fmt.Errorf("error opening %s: %w", artifactRef.StringWithinTransport(), err)
+	}
+	defer dest.Close()
+	for i, blob := range [][]byte{emptyConfig, contents} {
+		if _, err := dest.PutBlob(ctx, bytes.NewReader(blob), types.BlobInfo{
+			Digest: digest.FromBytes(blob),
+			Size:   int64(len(blob)),
+		}, none.NoCache, i == 0); err != nil {
+			return "", fmt.Errorf("error uploading artifact blob: %w", err)
+		}
+	}
+	if err := dest.PutManifest(ctx, artifactManifest, nil); err != nil {
+		return "", fmt.Errorf("error uploading artifact manifest: %w", err)
+	}
+	if err := dest.Commit(ctx, nil); err != nil {
+		return "", fmt.Errorf("error committing artifact: %w", err)
+	}
+	if err := addReferrersTag(ctx, sysCtx, named, subject.Digest, imagespec.Descriptor{
+		MediaType:    imagespec.MediaTypeImageManifest,
+		ArtifactType: artifactType,
+		Digest:       artifactDigest,
+		Size:         int64(len(artifactManifest)),
+	}); err != nil {
+		return "", err
+	}
+	return artifactDigest, nil
+}
+
+// Add `referrer` to the index at the `ALG-HEX` tag for `subject` (the referrers tag
+// schema fallback in the OCI distribution spec)
+func addReferrersTag(ctx context.Context, sysCtx *types.SystemContext, named reference.Named, subject digest.Digest, referrer imagespec.Descriptor) error {
+	tagged, err := reference.WithTag(reference.TrimNamed(named), subject.Algorithm().String()+"-"+subject.Encoded())
+	if err != nil {
+		panic(err)
+	}
+	tagRef, err := docker.NewReference(tagged)
+	if err != nil {
+		return fmt.Errorf("error creating referrers tag ref: %w", err)
+	}
+	index := imagespec.Index{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		MediaType: imagespec.MediaTypeImageIndex,
+		Manifests: []imagespec.Descriptor{},
+	}
+	source, err := tagRef.NewImageSource(ctx, sysCtx)
+	if err == nil {
+		existing, _, err := source.GetManifest(ctx, nil)
+		source.Close()
+		if err == nil {
+			if err := json.Unmarshal(existing, &index); err != nil {
+				return fmt.Errorf("error parsing existing referrers index at %s: %w", tagRef.StringWithinTransport(), err)
+			}
+		}
+	}
+	for _, m := range index.Manifests {
+		if m.Digest == referrer.Digest {
+			return nil
+		}
+	}
+	index.Manifests = append(index.Manifests, referrer)
+	indexJson, err := json.Marshal(index)
+	if err != nil {
+		panic(err)
+	}
+	dest, err := tagRef.NewImageDestination(ctx, sysCtx)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", tagRef.StringWithinTransport(), err)
+	}
+	defer dest.Close()
+	if err := dest.PutManifest(ctx, indexJson, nil); err != nil {
+		return fmt.Errorf("error uploading referrers index: %w", err)
+	}
+	if err := dest.Commit(ctx, nil); err != nil {
+		return fmt.Errorf("error committing referrers index: %w", err)
+	}
+	return nil
+}
+
+// Look up the descriptor of the top level manifest of the subject image
+func resolveSubject(ctx context.Context, subject ConfigSubject, authFile dinkerlib.AbsPath) (*imagespec.Descriptor, error) {
+	ref, err := alltransports.ParseImageName(subject.Ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subject image ref %s: %w", subject.Ref, err)
+	}
+	sysCtx, cleanup, err := registryArgs{Http: subject.Http, AuthFile: authFile}.systemContext()
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	if subject.User != "" || subject.Password != "" {
+		sysCtx.DockerAuthConfig = &types.DockerAuthConfig{
+			Username: subject.User,
+			Password: subject.Password,
+		}
+	}
+	source, err := ref.NewImageSource(ctx, sysCtx)
+	if err != nil {
+		return nil, fmt.Errorf("error accessing subject image %s: %w", subject.Ref, err)
+	}
+	defer source.Close()
+	subjectManifest, subjectManifestType, err := source.GetManifest(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error getting manifest for subject image %s: %w", subject.Ref, err)
+	}
+	subjectDigest, err := manifest.Digest(subjectManifest)
+	if err != nil {
+		return nil, fmt.Errorf("error digesting manifest for subject image %s: %w", subject.Ref, err)
+	}
+	return &imagespec.Descriptor{
+		MediaType: subjectManifestType,
+		Digest:    subjectDigest,
+		Size:      int64(len(subjectManifest)),
+	}, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/andrewbaxter/dinker/dinkerlib"
+	"github.com/containers/image/v5/pkg/tlsclientconfig"
+	"github.com/containers/image/v5/types"
+)
+
+// Connection settings for a registry or daemon, shared by FROM and dests
+type registryArgs struct {
+	Http       bool
+	Host       string
+	CaCert     dinkerlib.AbsPath
+	ClientCert dinkerlib.AbsPath
+	ClientKey  dinkerlib.AbsPath
+	// Podman/skopeo style auth file to read credentials from, if not the default
+	AuthFile dinkerlib.AbsPath
+}
+
+// Build the context for accessing a registry. The returned cleanup function
+// deletes any temporary files and should be called once the context is no longer
+// used.
+func (a registryArgs) systemContext() (*types.SystemContext, func(), error) {
+	cleanup := func() {}
+	var noHttpVerify types.OptionalBool
+	if a.Http {
+		noHttpVerify = types.OptionalBoolTrue
+	}
+	sysCtx := &types.SystemContext{
+		DockerInsecureSkipTLSVerify:       noHttpVerify,
+		DockerDaemonHost:                  a.Host,
+		DockerDaemonInsecureSkipTLSVerify: a.Http,
+		OCIInsecureSkipTLSVerify:          a.Http,
+	}
+	if a.AuthFile != "" {
+		sysCtx.AuthFilePath = a.AuthFile.Raw()
+	}
+	if (a.ClientCert == "") != (a.ClientKey == "") {
+		return nil, nil, fmt.Errorf("registry client certificate and key must be specified together")
+	}
+	if a.CaCert != "" || a.ClientCert != "" {
+		// Containers/image reads certificates from a directory with a specific layout
+		certDir, err := os.MkdirTemp("", ".dinker-certs-*")
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to create temp dir for registry certificates: %w", err)
+		}
+		cleanup = func() {
+			if err := os.RemoveAll(certDir); err != nil {
+				log.Printf("Error deleting temp registry certificates dir at %s: %s", certDir, err)
+			}
+		}
+		for dest, source := range map[string]dinkerlib.AbsPath{
+			"ca.crt":      a.CaCert,
+			"client.cert": a.ClientCert,
+			"client.key":  a.ClientKey,
+		} {
+			if source == "" {
+				continue
+			}
+			contents, err := os.ReadFile(source.Raw())
+			if err != nil {
+				cleanup()
+				return nil, nil, fmt.Errorf("error reading registry certificate file %s: %w", source, err)
+			}
+			if err := os.WriteFile(filepath.Join(certDir, dest), contents, 0o600); err != nil {
+				cleanup()
+				return nil, nil, fmt.Errorf("error copying registry certificate file %s to temp dir: %w", source, err)
+			}
+		}
+		sysCtx.DockerCertPath = certDir
+		sysCtx.OCICertPath = certDir
+	}
+	return sysCtx, cleanup, nil
+}
+
+// An http client for talking to the registry directly, with the TLS settings
+// (ca_cert, client cert, and http) of the context
+func registryHttpClient(sysCtx *types.SystemContext) (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: sysCtx.DockerInsecureSkipTLSVerify == types.OptionalBoolTrue}
+	if sysCtx.DockerCertPath != "" {
+		if err := tlsclientconfig.SetupCertificates(sysCtx.DockerCertPath, tlsConfig); err != nil {
+			return nil, fmt.Errorf("error loading registry certificates: %w", err)
+		}
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}, nil
+}
+
+// Build the context for pushing to `destRef` (`destString` after variable
+// substitution), including credentials
+func (dest ConfigDest) systemContext(ctx context.Context, destString string, destRef types.ImageReference, authFile dinkerlib.AbsPath) (*types.SystemContext, func(), error) {
+	sysCtx, cleanup, err := registryArgs{
+		Http:       dest.Http,
+		Host:       dest.Host,
+		CaCert:     dest.CaCert,
+		ClientCert: dest.ClientCert,
+		ClientKey:  dest.ClientKey,
+		AuthFile:   authFile,
+	}.systemContext()
+	if err != nil {
+		return nil, nil, err
+	}
+	if dest.Token != "" && (dest.User != "" || dest.Password != "" || dest.IdentityToken != "") {
+		cleanup()
+		return nil, nil, fmt.Errorf("dest %s token can't be used with other credentials", destString)
+	}
+	sysCtx.DockerBearerRegistryToken = dest.Token
+	if dest.Auth != "" {
+		if dest.User != "" || dest.Password != "" || dest.Token != "" || dest.IdentityToken != "" {
+			cleanup()
+			return nil, nil, fmt.Errorf("dest %s auth can't be used with other credentials", destString)
+		}
+		sysCtx.DockerAuthConfig, err = registryAuth(ctx, dest.Auth, destRef, sysCtx)
+		if err != nil {
+			cleanup()
+			return nil, nil, fmt.Errorf("error getting credentials for dest %s: %w", destString, err)
+		}
+	} else if dest.User != "" || dest.Password != "" || dest.IdentityToken != "" {
+		sysCtx.DockerAuthConfig = &types.DockerAuthConfig{
+			Username:      dest.User,
+			Password:      dest.Password,
+			IdentityToken: dest.IdentityToken,
+		}
+	}
+	// Otherwise credentials are looked up in docker/podman auth files (or
+	// `authFile`), including running credential helpers
+	return sysCtx, cleanup, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Generates a JSON Schema for json-decoded types. Named structs are put in
+// `$defs` so recursive types (ex: dirs in dirs) work.
+type schemaBuilder struct {
+	defs map[string]any
+}
+
+func (b *schemaBuilder) schema(t reflect.Type) any {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return b.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		ref := map[string]any{"$ref": "#/$defs/" + t.Name()}
+		if _, seen := b.defs[t.Name()]; seen {
+			return ref
+		}
+		// Placeholder while generating, for recursion
+		b.defs[t.Name()] = nil
+		properties := map[string]any{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" || !field.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = b.schema(field.Type)
+		}
+		b.defs[t.Name()] = map[string]any{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+		return ref
+	default:
+		panic(fmt.Sprintf("no json schema for config type %s", t))
+	}
+}
+
+// Print a JSON Schema for the config to stdout
+func schemaCommand() error {
+	b := schemaBuilder{defs: map[string]any{}}
+	root := b.schema(reflect.TypeOf(Config{})).(map[string]any)
+	root["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	root["title"] = "dinker config"
+	root["$defs"] = b.defs
+	out, err := json.MarshalIndent(root, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	if _, err := fmt.Fprintln(os.Stdout, string(out)); err != nil {
+		return fmt.Errorf("error writing schema: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/andrewbaxter/dinker/dinkerlib"
+)
+
+// Resolve a credential value that may reference a secret: `env:NAME` reads an
+// environment variable and `file:PATH` reads a file (ex: a docker/kubernetes
+// secret, with the trailing newline removed). Other values are used as-is.
+func resolveSecret(field string, value string) (string, error) {
+	if name, found := strings.CutPrefix(value, "env:"); found {
+		v, found := os.LookupEnv(name)
+		if !found {
+			return "", fmt.Errorf("%s references environment variable %s which isn't set", field, name)
+		}
+		return v, nil
+	}
+	if p, found := strings.CutPrefix(value, "file:"); found {
+		body, err := os.ReadFile(dinkerlib.MakeAbsPath(p).Raw())
+		if err != nil {
+			return "", fmt.Errorf("error reading %s secret file %s: %w", field, p, err)
+		}
+		return strings.TrimRight(string(body), "\r\n"), nil
+	}
+	return value, nil
+}
+
+// Replace secret references in all credential fields with their values
+func resolveConfigSecrets(config *Config) error {
+	resolve := func(field string, value *string) error {
+		v, err := resolveSecret(field, *value)
+		if err != nil {
+			return err
+		}
+		*value = v
+		return nil
+	}
+	fields := map[string]*string{
+		"from_password":       &config.FromPassword,
+		"from_token":          &config.FromToken,
+		"from_identity_token": &config.FromIdentityToken,
+	}
+	if config.Subject != nil {
+		fields["subject.password"] = &config.Subject.Password
+	}
+	for i := range config.Dests {
+		dest := &config.Dests[i]
+		fields[fmt.Sprintf("dests[%d].password", i)] = &dest.Password
+		fields[fmt.Sprintf("dests[%d].token", i)] = &dest.Token
+		fields[fmt.Sprintf("dests[%d].identity_token", i)] = &dest.IdentityToken
+		if dest.Sign != nil {
+			fields[fmt.Sprintf("dests[%d].sign.key_passphrase", i)] = &dest.Sign.KeyPassphrase
+			fields[fmt.Sprintf("dests[%d].sign.oidc_token", i)] = &dest.Sign.OidcToken
+		}
+	}
+	for field, value := range fields {
+		if err := resolve(field, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/andrewbaxter/dinker/dinkerlib"
+	"github.com/containers/image/v5/signature/signer"
+	"github.com/containers/image/v5/signature/sigstore"
+	"github.com/containers/image/v5/signature/sigstore/fulcio"
+	"github.com/containers/image/v5/signature/sigstore/rekor"
+)
+
+const sigstoreDefaultFulcio = "https://fulcio.sigstore.dev"
+const sigstoreDefaultRekor = "https://rekor.sigstore.dev"
+
+// Cosign compatible signing of pushed images, either with a key or keyless
+type ConfigSign struct {
+	Key           dinkerlib.AbsPath `json:"key"`
+	KeyPassphrase string            `json:"key_passphrase"`
+	OidcToken     string            `json:"oidc_token"`
+	Fulcio        string            `json:"fulcio"`
+	Rekor         string            `json:"rekor"`
+}
+
+func (c ConfigSign) signer() (*signer.Signer, error) {
+	opts := []sigstore.Option{}
+	rekorUrl := c.Rekor
+	switch {
+	case c.Key != "" && c.OidcToken != "":
+		return nil, fmt.Errorf("sign key and oidc_token can't both be specified")
+	case c.Key != "":
+		opts = append(opts, sigstore.WithPrivateKeyFile(c.Key.Raw(), []byte(c.KeyPassphrase)))
+	case c.OidcToken != "":
+		fulcioUrl, err := url.Parse(dinkerlib.Def(c.Fulcio, sigstoreDefaultFulcio))
+		if err != nil {
+			return nil, fmt.Errorf("invalid fulcio url %s: %w", c.Fulcio, err)
+		}
+		opts = append(opts, fulcio.WithFulcioAndPreexistingOIDCIDToken(fulcioUrl, c.OidcToken))
+		// Keyless signatures can't be verified without the transparency log
+		rekorUrl = dinkerlib.Def(rekorUrl, sigstoreDefaultRekor)
+	default:
+		return nil, fmt.Errorf("sign needs either key or oidc_token")
+	}
+	if rekorUrl != "" {
+		rekorUrl1, err := url.Parse(rekorUrl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rekor url %s: %w", rekorUrl, err)
+		}
+		opts = append(opts, rekor.WithRekor(rekorUrl1))
+	}
+	s, err := sigstore.NewSigner(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up sigstore signer: %w", err)
+	}
+	return s, nil
+}
+
+// Write a registries.d config enabling storing sigstore signatures in the registry
+// (like cosign), returning the dir path and a cleanup function
+func writeSigstoreRegistriesD() (string, func(), error) {
+	dir, err := os.MkdirTemp("", ".dinker-registries.d-*")
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to create temp registries.d dir for signing: %w", err)
+	}
+	cleanup := func() {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("Error deleting temp registries.d dir at %s: %s", dir, err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "dinker.yaml"), []byte("default-docker:\n  use-sigstore-attachments: true\n"), 0o644); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("error writing temp registries.d config for signing: %w", err)
+	}
+	return dir, cleanup, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/andrewbaxter/dinker/dinkerlib"
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/opencontainers/go-digest"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type LayerSize struct {
+	Digest           digest.Digest `json:"digest"`
+	Size             int64         `json:"size"`
+	UncompressedSize int64         `json:"uncompressed_size"`
+}
+
+// Sizes of a built image
+type ImageSize struct {
+	// For multi-platform images
+	Platform *imagespec.Platform `json:"platform,omitempty"`
+	Layers   []LayerSize         `json:"layers"`
+	// Config and layers as stored in registries
+	Size             int64 `json:"size"`
+	UncompressedSize int64 `json:"uncompressed_size"`
+}
+
+func layoutBlobPath(layoutDir dinkerlib.AbsPath, d digest.Digest) dinkerlib.AbsPath {
+	return layoutDir.Join("blobs").Join(d.Algorithm().String()).Join(d.Encoded())
+}
+
+// Measure the layers of the image with manifest `m` in an oci layout, decompressing
+// them to get uncompressed sizes
+func measureImage(layoutDir dinkerlib.AbsPath, m imagespec.Manifest) (ImageSize, error) {
+	out := ImageSize{
+		Layers:           []LayerSize{},
+		Size:             m.Config.Size,
+		UncompressedSize: m.Config.Size,
+	}
+	for _, l := range m.Layers {
+		uncompressedSize, err := func() (int64, error) {
+			f, err := os.Open(layoutBlobPath(layoutDir, l.Digest).Raw())
+			if err != nil {
+				return 0, fmt.Errorf("error opening layer: %w", err)
+			}
+			defer f.Close()
+			r, _, err := compression.AutoDecompress(f)
+			if err != nil {
+				return 0, fmt.Errorf("error decompressing layer: %w", err)
+			}
+			defer r.Close()
+			return io.Copy(io.Discard, r)
+		}()
+		if err != nil {
+			return ImageSize{}, fmt.Errorf("error measuring layer %s: %w", l.Digest, err)
+		}
+		out.Layers = append(out.Layers, LayerSize{
+			Digest:           l.Digest,
+			Size:             l.Size,
+			UncompressedSize: uncompressedSize,
+		})
+		out.Size += l.Size
+		out.UncompressedSize += uncompressedSize
+	}
+	return out, nil
+}
+
+// Measure each image in an index in an oci layout
+func measureIndex(layoutDir dinkerlib.AbsPath, index imagespec.Index) ([]ImageSize, error) {
+	out := []ImageSize{}
+	for _, d := range index.Manifests {
+		manifestJson, err := os.ReadFile(layoutBlobPath(layoutDir, d.Digest).Raw())
+		if err != nil {
+			return nil, fmt.Errorf("error reading image manifest %s: %w", d.Digest, err)
+		}
+		var m imagespec.Manifest
+		if err := json.Unmarshal(manifestJson, &m); err != nil {
+			return nil, fmt.Errorf("error parsing image manifest %s: %w", d.Digest, err)
+		}
+		size, err := measureImage(layoutDir, m)
+		if err != nil {
+			return nil, err
+		}
+		size.Platform = d.Platform
+		out = append(out, size)
+	}
+	return out, nil
+}
+
+func logImageSize(size ImageSize) {
+	for i, l := range size.Layers {
+		logEvent("layer_size", logFields{
+			"digest":             l.Digest,
+			"bytes":              l.Size,
+			"uncompressed_bytes": l.UncompressedSize,
+		}, "Layer %d %s: %d bytes, %d bytes uncompressed", i, l.Digest, l.Size, l.UncompressedSize)
+	}
+	fields := logFields{
+		"bytes":              size.Size,
+		"uncompressed_bytes": size.UncompressedSize,
+	}
+	platform := ""
+	if size.Platform != nil {
+		platform = fmt.Sprintf(" for %s/%s", size.Platform.OS, size.Platform.Architecture)
+		fields["os"] = size.Platform.OS
+		fields["arch"] = size.Platform.Architecture
+	}
+	logEvent("image_size", fields, "Image size%s: %d bytes, %d bytes uncompressed", platform, size.Size, size.UncompressedSize)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+
+	"github.com/andrewbaxter/dinker/dinkerlib"
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/blobinfocache"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+)
+
+var refVarRegex = regexp.MustCompile(`\{[a-z_]+\}`)
+
+// Writes the built image straight to a registry
+type streamDest struct {
+	dest     types.ImageDestination
+	cache    types.BlobInfoCache
+	manifest []byte
+	stats    PushStats
+}
+
+func (d *streamDest) PutBlob(ctx context.Context, blobDigest digest.Digest, size int64, contents io.Reader, isConfig bool) error {
+	info := types.BlobInfo{
+		Digest: blobDigest,
+		Size:   size,
+	}
+	// Skip blobs the registry already has (ex: FROM layers)
+	reused, _, err := d.dest.TryReusingBlob(ctx, info, d.cache, false)
+	if err == nil && reused {
+		d.stats.SkippedBlobs += 1
+		d.stats.SkippedBytes += size
+		return nil
+	}
+	if _, err := d.dest.PutBlob(ctx, contents, info, d.cache, isConfig); err != nil {
+		return err
+	}
+	d.stats.UploadedBlobs += 1
+	d.stats.UploadedBytes += size
+	return nil
+}
+
+func (d *streamDest) PutManifest(ctx context.Context, m []byte) error {
+	d.manifest = m
+	return d.dest.PutManifest(ctx, m, nil)
+}
+
+// Build the image directly into a registry dest, without writing a layout to disk
+// first (new layers are still built in temp files). `fromLayers` are mounted from the `fromPull` repo if it's in the same
+// registry.
+func streamPush(ctx context.Context, dest ConfigDest, buildArgs dinkerlib.BuildImageArgs, refVars map[string]string, fromPull string, fromLayers []digest.Digest, authFile dinkerlib.AbsPath) (Result, error) {
+	destString, err := expandDestRef(dest.Ref, refVars)
+	if err != nil {
+		return Result{}, err
+	}
+	if v := refVarRegex.FindString(destString); v != "" {
+		return Result{}, fmt.Errorf("dest ref %s uses %s which isn't known until after the build, so it can't be used with stream", dest.Ref, v)
+	}
+	destRef, err := alltransports.ParseImageName(destString)
+	if err != nil {
+		return Result{}, fmt.Errorf("invalid dest image ref %s: %w", destString, err)
+	}
+	if destRef.Transport().Name() != docker.Transport.Name() {
+		return Result{}, fmt.Errorf("stream only supports registry dests (docker://), but got %s", destString)
+	}
+	sysCtx, cleanup, err := dest.systemContext(ctx, destString, destRef, authFile)
+	if err != nil {
+		return Result{}, err
+	}
+	defer cleanup()
+	imgDest, err := destRef.NewImageDestination(ctx, sysCtx)
+	if err != nil {
+		return Result{}, fmt.Errorf("error opening dest %s: %w", destString, err)
+	}
+	defer imgDest.Close()
+	cache := blobinfocache.DefaultCache(sysCtx)
+	recordFromLayerLocations(cache, fromPull, fromLayers)
+	sd := &streamDest{dest: imgDest, cache: cache}
+	buildArgs.Dest = sd
+
+	logEvent("push_start", logFields{"ref": destString}, "Building and pushing to %s...", destString)
+	hash, err := dinkerlib.BuildImageContext(ctx, buildArgs)
+	if err != nil {
+		return Result{}, fmt.Errorf("error building image: %w", err)
+	}
+	if err := imgDest.Commit(ctx, nil); err != nil {
+		return Result{}, fmt.Errorf("error committing image to %s: %w", destString, err)
+	}
+
+	manifestDigest, err := manifest.Digest(sd.manifest)
+	if err != nil {
+		return Result{}, fmt.Errorf("error digesting built image manifest: %w", err)
+	}
+	logEvent("push_done", sd.stats.logFields(logFields{
+		"ref":             destString,
+		"manifest_digest": manifestDigest,
+		"hash":            hash,
+	}), "Building and pushing to %s... done, %s.", destString, sd.stats)
+	ociManifest, err := manifest.OCI1FromManifest(sd.manifest)
+	if err != nil {
+		return Result{}, fmt.Errorf("error parsing built image manifest: %w", err)
+	}
+	return Result{
+		Hash:           hash,
+		ManifestDigest: manifestDigest,
+		ConfigDigest:   ociManifest.Config.Digest,
+		Layers:         ociManifest.Layers,
+		Dests: []ResultDest{
+			{
+				Ref:            destString,
+				ManifestDigest: manifestDigest,
+				Stats:          &sd.stats,
+			},
+		},
+	}, nil
+}
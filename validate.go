@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/andrewbaxter/dinker/dinkerlib"
+)
+
+// Find keys in the json that don't match any field (and would be silently
+// ignored when parsing)
+func unknownKeys(at string, value any, t reflect.Type) []error {
+	join := func(k string) string {
+		if at == "" {
+			return k
+		}
+		return at + "." + k
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	errs := []error{}
+	switch value := value.(type) {
+	case []any:
+		if t.Kind() != reflect.Slice {
+			return nil
+		}
+		for i, v := range value {
+			errs = append(errs, unknownKeys(fmt.Sprintf("%s[%d]", at, i), v, t.Elem())...)
+		}
+	case map[string]any:
+		keys := []string{}
+		for k := range value {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		if t.Kind() == reflect.Map {
+			for _, k := range keys {
+				errs = append(errs, unknownKeys(join(k), value[k], t.Elem())...)
+			}
+			return errs
+		}
+		if t.Kind() != reflect.Struct || t == reflect.TypeOf(time.Time{}) {
+			return nil
+		}
+		for _, k := range keys {
+			var field *reflect.StructField
+			for i := 0; i < t.NumField(); i++ {
+				f := t.Field(i)
+				name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+				if name == "-" || !f.IsExported() {
+					continue
+				}
+				// Matched case insensitively, like encoding/json
+				if strings.EqualFold(dinkerlib.Def(name, f.Name), k) {
+					field = &f
+					break
+				}
+			}
+			if field == nil {
+				errs = append(errs, fmt.Errorf("unknown key %s", join(k)))
+				continue
+			}
+			errs = append(errs, unknownKeys(join(k), value[k], field.Type)...)
+		}
+	}
+	return errs
+}
+
+// Check the config thoroughly without building or pushing, logging every problem
+// found
+func validateCommand(configPath string, configJson []byte, configs []Config) error {
+	var raw any
+	if err := json.Unmarshal(configJson, &raw); err != nil {
+		return fmt.Errorf("error parsing config json at %s: %w", configPath, err)
+	}
+	errs := unknownKeys("", raw, reflect.TypeOf(Config{}))
+	if _, err := proxyEnv(configs); err != nil {
+		errs = append(errs, err)
+	}
+	outputDirs := map[dinkerlib.AbsPath]int{}
+	for i, config := range configs {
+		if config.OutputDir != "" {
+			if j, seen := outputDirs[config.OutputDir]; seen {
+				errs = append(errs, fmt.Errorf("images %d and %d have the same output_dir %s", j, i, config.OutputDir))
+			}
+			outputDirs[config.OutputDir] = i
+		}
+		for _, err := range validateConfig(config) {
+			if len(configs) > 1 {
+				err = fmt.Errorf("image %d: %w", i, err)
+			}
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) != 0 {
+		for _, err := range errs {
+			log.Printf("Problem: %s", err)
+		}
+		return fmt.Errorf("found %d problems in config %s", len(errs), configPath)
+	}
+	logInfo("Config %s is valid", configPath)
+	return nil
+}
+
+// Check one image's config
+func validateConfig(config Config) []error {
+	errs := checkConfig(config)
+	errs = append(errs, checkConfigFiles(config)...)
+
+	// Build inputs
+	fromPath := config.From
+	platforms := config.Platforms
+	if config.FromPull != "" || config.FromDaemon != "" {
+		// Pulled if missing
+		fromPath = ""
+		platforms = []dinkerlib.BuildImageArgsPlatform{}
+		for _, p := range config.Platforms {
+			p.FromPath = ""
+			platforms = append(platforms, p)
+		}
+	}
+	copyFrom := []dinkerlib.AbsPath{}
+	for i, p := range config.CopyFrom {
+		if i < len(config.CopyFromPull) && config.CopyFromPull[i] != "" {
+			// Pulled if missing
+			continue
+		}
+		copyFrom = append(copyFrom, p)
+	}
+	errs = append(errs, dinkerlib.ValidateBuildImageArgs(dinkerlib.BuildImageArgs{
+		FromPath:       fromPath,
+		FromRootfs:     config.FromRootfs,
+		CopyFrom:       copyFrom,
+		Platforms:      platforms,
+		Files:          config.Files,
+		Dirs:           config.Dirs,
+		Devices:        config.Devices,
+		Remove:         config.Remove,
+		Nix:            config.Nix,
+		IncludeCaCerts: config.IncludeCaCerts,
+		CaCertsSource:  config.CaCertsSource,
+		Layers:         config.Layers,
+		Ports:          config.Ports,
+		RemovePorts:    config.RemovePorts,
+		User:           config.User,
+		CreateUser:     config.CreateUser,
+	})...)
+	return errs
+}
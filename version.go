@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	"github.com/containers/image/v5/transports"
+)
+
+// Set when building releases with `-ldflags "-X main.version=..."`
+var version = ""
+
+// Print the dinker version and versions of things that affect registry
+// compatibility
+func versionCommand() error {
+	dinkerVersion := version
+	commit := "unknown"
+	imageVersion := "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if dinkerVersion == "" {
+			dinkerVersion = info.Main.Version
+		}
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				commit = s.Value
+			case "vcs.modified":
+				if s.Value == "true" {
+					commit += " (modified)"
+				}
+			}
+		}
+		for _, dep := range info.Deps {
+			if dep.Path == "github.com/containers/image/v5" {
+				imageVersion = dep.Version
+				if dep.Replace != nil {
+					imageVersion = fmt.Sprintf("%s (replaced by %s %s)", dep.Version, dep.Replace.Path, dep.Replace.Version)
+				}
+			}
+		}
+	}
+	fmt.Printf("dinker %s\n", dinkerVersion)
+	fmt.Printf("commit: %s\n", commit)
+	fmt.Printf("containers/image: %s\n", imageVersion)
+	fmt.Printf("go: %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	// containerd is handled by dinker rather than containers/image
+	fmt.Printf("transports: %s, containerd\n", strings.Join(transports.ListNames(), ", "))
+	return nil
+}